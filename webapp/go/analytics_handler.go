@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// from, toを省略した場合の集計期間
+	defaultAnalyticsPeriod = 7 * 24 * time.Hour
+	maxAnalyticsPeriod     = 366 * 24 * time.Hour
+	analyticsTopUsersLimit = 10
+)
+
+type AnalyticsSummary struct {
+	Livecomments int64 `json:"livecomments"`
+	Tips         int64 `json:"tips"`
+	Reactions    int64 `json:"reactions"`
+	Reports      int64 `json:"reports"`
+	// 配信ごとの視聴者数の合計
+	Viewers int64 `json:"viewers"`
+}
+
+func (s AnalyticsSummary) add(o AnalyticsSummary) AnalyticsSummary {
+	return AnalyticsSummary{
+		Livecomments: s.Livecomments + o.Livecomments,
+		Tips:         s.Tips + o.Tips,
+		Reactions:    s.Reactions + o.Reactions,
+		Reports:      s.Reports + o.Reports,
+		Viewers:      s.Viewers + o.Viewers,
+	}
+}
+
+func (s AnalyticsSummary) sub(o AnalyticsSummary) AnalyticsSummary {
+	return AnalyticsSummary{
+		Livecomments: s.Livecomments - o.Livecomments,
+		Tips:         s.Tips - o.Tips,
+		Reactions:    s.Reactions - o.Reactions,
+		Reports:      s.Reports - o.Reports,
+		Viewers:      s.Viewers - o.Viewers,
+	}
+}
+
+func (s AnalyticsSummary) isZero() bool {
+	return s == AnalyticsSummary{}
+}
+
+type LivestreamAnalytics struct {
+	LivestreamID int64  `json:"livestream_id"`
+	Title        string `json:"title"`
+	StartAt      int64  `json:"start_at"`
+	EndAt        int64  `json:"end_at"`
+	AnalyticsSummary
+}
+
+type AnalyticsUser struct {
+	User  User  `json:"user"`
+	Total int64 `json:"total"`
+}
+
+type AnalyticsEmoji struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+type UserAnalytics struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// 直前の同じ長さの期間
+	PreviousFrom int64            `json:"previous_from"`
+	Summary      AnalyticsSummary `json:"summary"`
+	Previous     AnalyticsSummary `json:"previous"`
+	// SummaryからPreviousを引いた差分
+	Change        AnalyticsSummary      `json:"change"`
+	Livestreams   []LivestreamAnalytics `json:"livestreams"`
+	TopTippers    []AnalyticsUser       `json:"top_tippers"`
+	TopCommenters []AnalyticsUser       `json:"top_commenters"`
+	Emojis        []AnalyticsEmoji      `json:"emojis"`
+}
+
+type livestreamAnalyticsRow struct {
+	LivestreamID int64  `db:"livestream_id"`
+	Title        string `db:"title"`
+	StartAt      int64  `db:"start_at"`
+	EndAt        int64  `db:"end_at"`
+	Livecomments int64  `db:"livecomments"`
+	Tips         int64  `db:"tips"`
+	Reactions    int64  `db:"reactions"`
+	Reports      int64  `db:"reports"`
+	Viewers      int64  `db:"viewers"`
+}
+
+type analyticsUserRow struct {
+	UserModel
+	Total int64 `db:"total"`
+}
+
+// 配信者向け分析API
+// 自分の全配信について、[from, to) の期間の集計と直前の同じ長さの期間との比較を返す
+// GET /api/user/me/analytics
+func getMyAnalyticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	to := time.Now().Unix()
+	if c.QueryParam("to") != "" {
+		v, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+		}
+		to = v
+	}
+	from := to - int64(defaultAnalyticsPeriod/time.Second)
+	if c.QueryParam("from") != "" {
+		v, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+		from = v
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if to-from > int64(maxAnalyticsPeriod/time.Second) {
+		return echo.NewHTTPError(http.StatusBadRequest, "period between from and to must be at most 366 days")
+	}
+	previousFrom := from - (to - from)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rows, err := getLivestreamAnalyticsRows(ctx, tx, userID, from, to)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream analytics: "+err.Error())
+	}
+	previousRows, err := getLivestreamAnalyticsRows(ctx, tx, userID, previousFrom, from)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get previous livestream analytics: "+err.Error())
+	}
+
+	var summary, previous AnalyticsSummary
+	livestreams := []LivestreamAnalytics{}
+	for _, row := range rows {
+		s := AnalyticsSummary{
+			Livecomments: row.Livecomments,
+			Tips:         row.Tips,
+			Reactions:    row.Reactions,
+			Reports:      row.Reports,
+			Viewers:      row.Viewers,
+		}
+		summary = summary.add(s)
+		// 期間と重ならず、期間内の反応もない配信は含めない
+		if s.isZero() && (row.EndAt <= from || row.StartAt >= to) {
+			continue
+		}
+		livestreams = append(livestreams, LivestreamAnalytics{
+			LivestreamID:     row.LivestreamID,
+			Title:            row.Title,
+			StartAt:          row.StartAt,
+			EndAt:            row.EndAt,
+			AnalyticsSummary: s,
+		})
+	}
+	for _, row := range previousRows {
+		previous = previous.add(AnalyticsSummary{
+			Livecomments: row.Livecomments,
+			Tips:         row.Tips,
+			Reactions:    row.Reactions,
+			Reports:      row.Reports,
+			Viewers:      row.Viewers,
+		})
+	}
+
+	topTippers, err := getTopAnalyticsUsers(ctx, tx, "SUM(lc.tip)", "lc.tip > 0", userID, from, to)
+	if err != nil {
+		return err
+	}
+	topCommenters, err := getTopAnalyticsUsers(ctx, tx, "COUNT(*)", "TRUE", userID, from, to)
+	if err != nil {
+		return err
+	}
+
+	emojis := []AnalyticsEmoji{}
+	query := `
+	SELECT r.emoji_name, COUNT(*) AS count
+	FROM reactions r
+	INNER JOIN livestreams l ON l.id = r.livestream_id
+	WHERE l.user_id = ? AND r.created_at >= ? AND r.created_at < ?
+	GROUP BY r.emoji_name
+	ORDER BY count DESC, r.emoji_name DESC
+	`
+	if err := tx.SelectContext(ctx, &emojis, query, userID, from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get emoji distribution: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UserAnalytics{
+		From:          from,
+		To:            to,
+		PreviousFrom:  previousFrom,
+		Summary:       summary,
+		Previous:      previous,
+		Change:        summary.sub(previous),
+		Livestreams:   livestreams,
+		TopTippers:    topTippers,
+		TopCommenters: topCommenters,
+		Emojis:        emojis,
+	})
+}
+
+// getLivestreamAnalyticsRows は配信者の全配信について、[from, to) の期間の集計を配信ごとに返す
+func getLivestreamAnalyticsRows(ctx context.Context, tx *sqlx.Tx, userID, from, to int64) ([]*livestreamAnalyticsRow, error) {
+	query := `
+	SELECT
+		l.id AS livestream_id, l.title, l.start_at, l.end_at,
+		IFNULL(c.livecomments, 0) AS livecomments, IFNULL(c.tips, 0) AS tips,
+		IFNULL(r.reactions, 0) AS reactions, IFNULL(rp.reports, 0) AS reports, IFNULL(v.viewers, 0) AS viewers
+	FROM livestreams l
+	LEFT JOIN (
+		SELECT lc.livestream_id, COUNT(*) AS livecomments, SUM(lc.tip) AS tips FROM livecomments lc
+		INNER JOIN livestreams l ON l.id = lc.livestream_id
+		WHERE l.user_id = ? AND lc.created_at >= ? AND lc.created_at < ? AND lc.hidden_at IS NULL
+		GROUP BY lc.livestream_id
+	) c ON c.livestream_id = l.id
+	LEFT JOIN (
+		SELECT r.livestream_id, COUNT(*) AS reactions FROM reactions r
+		INNER JOIN livestreams l ON l.id = r.livestream_id
+		WHERE l.user_id = ? AND r.created_at >= ? AND r.created_at < ?
+		GROUP BY r.livestream_id
+	) r ON r.livestream_id = l.id
+	LEFT JOIN (
+		SELECT rp.livestream_id, COUNT(*) AS reports FROM livecomment_reports rp
+		INNER JOIN livestreams l ON l.id = rp.livestream_id
+		WHERE l.user_id = ? AND rp.created_at >= ? AND rp.created_at < ?
+		GROUP BY rp.livestream_id
+	) rp ON rp.livestream_id = l.id
+	LEFT JOIN (
+		SELECT ws.livestream_id, COUNT(DISTINCT ws.user_id) AS viewers FROM watch_sessions ws
+		INNER JOIN livestreams l ON l.id = ws.livestream_id
+		WHERE l.user_id = ? AND ws.started_at >= ? AND ws.started_at < ?
+		GROUP BY ws.livestream_id
+	) v ON v.livestream_id = l.id
+	WHERE l.user_id = ?
+	ORDER BY l.start_at DESC, l.id DESC
+	`
+	var rows []*livestreamAnalyticsRow
+	if err := tx.SelectContext(ctx, &rows, query,
+		userID, from, to,
+		userID, from, to,
+		userID, from, to,
+		userID, from, to,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// getTopAnalyticsUsers は配信者の配信へのライブコメントを送ったユーザを、aggregateの降順で返す
+func getTopAnalyticsUsers(ctx context.Context, tx *sqlx.Tx, aggregate, condition string, userID, from, to int64) ([]AnalyticsUser, error) {
+	query := `
+	SELECT u.*, t.total FROM users u
+	INNER JOIN (
+		SELECT lc.user_id, ` + aggregate + ` AS total FROM livecomments lc
+		INNER JOIN livestreams l ON l.id = lc.livestream_id
+		WHERE l.user_id = ? AND lc.created_at >= ? AND lc.created_at < ? AND lc.hidden_at IS NULL AND ` + condition + `
+		GROUP BY lc.user_id
+	) t ON t.user_id = u.id
+	ORDER BY t.total DESC, u.id ASC
+	LIMIT ?
+	`
+	var rows []*analyticsUserRow
+	if err := tx.SelectContext(ctx, &rows, query, userID, from, to, analyticsTopUsersLimit); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get top users: "+err.Error())
+	}
+
+	users := make([]AnalyticsUser, len(rows))
+	for i, row := range rows {
+		user, err := fillUserResponse(ctx, tx, row.UserModel)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		users[i] = AnalyticsUser{
+			User:  user,
+			Total: row.Total,
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CounterDrift struct {
+	// livestreamまたはuser
+	Target string `json:"target"`
+	ID     int64  `json:"id"`
+	// テーブル名.カラム名
+	Column string `json:"column"`
+	Stored int64  `json:"stored"`
+	Actual int64  `json:"actual"`
+}
+
+type StatsAuditResponse struct {
+	CheckedLivestreams int64          `json:"checked_livestreams"`
+	CheckedUsers       int64          `json:"checked_users"`
+	Drifts             []CounterDrift `json:"drifts"`
+}
+
+type denormalizedCounters struct {
+	ID             int64 `db:"id"`
+	Tip            int64 `db:"tip"`
+	ReactionsCount int64 `db:"reactions_count"`
+}
+
+// 集計値の監査API
+// 非正規化したカラムと集計値のテーブルを、元のテーブルから求めた値と比較してずれを返す
+// 修正はreconcile-statsコマンドで行う
+// GET /api/admin/stats/audit
+func getStatsAuditHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamStats, userStats, err := computeStats(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compute stats: "+err.Error())
+	}
+
+	var livestreamCounters []*denormalizedCounters
+	if err := tx.SelectContext(ctx, &livestreamCounters, "SELECT id, tip, reactions_count FROM livestreams"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	var userCounters []*denormalizedCounters
+	if err := tx.SelectContext(ctx, &userCounters, "SELECT id, tip, reactions_count FROM users"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	var storedLivestreamStats []*LivestreamStatsModel
+	if err := tx.SelectContext(ctx, &storedLivestreamStats, "SELECT * FROM livestream_stats"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream stats: "+err.Error())
+	}
+	var storedUserStats []*UserStatsModel
+	if err := tx.SelectContext(ctx, &storedUserStats, "SELECT * FROM user_stats"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user stats: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	drifts := []CounterDrift{}
+
+	actualLivestreams := make(map[int64]StatsCounters, len(livestreamStats))
+	for _, s := range livestreamStats {
+		actualLivestreams[s.LivestreamID] = s.StatsCounters
+	}
+	storedLivestreams := make(map[int64]StatsCounters, len(storedLivestreamStats))
+	for _, s := range storedLivestreamStats {
+		storedLivestreams[s.LivestreamID] = s.StatsCounters
+	}
+	for _, counters := range livestreamCounters {
+		actual := actualLivestreams[counters.ID]
+		drifts = appendCounterDrifts(drifts, "livestream", counters.ID, "livestreams", counters, storedLivestreams[counters.ID], actual)
+	}
+
+	actualUsers := make(map[int64]StatsCounters, len(userStats))
+	for _, s := range userStats {
+		actualUsers[s.UserID] = s.StatsCounters
+	}
+	storedUsers := make(map[int64]StatsCounters, len(storedUserStats))
+	for _, s := range storedUserStats {
+		storedUsers[s.UserID] = s.StatsCounters
+	}
+	for _, counters := range userCounters {
+		actual := actualUsers[counters.ID]
+		drifts = appendCounterDrifts(drifts, "user", counters.ID, "users", counters, storedUsers[counters.ID], actual)
+	}
+
+	return c.JSON(http.StatusOK, &StatsAuditResponse{
+		CheckedLivestreams: int64(len(livestreamCounters)),
+		CheckedUsers:       int64(len(userCounters)),
+		Drifts:             drifts,
+	})
+}
+
+// appendCounterDrifts は非正規化したカラムと集計値のテーブルのうち、actualと異なるものを追加する
+func appendCounterDrifts(drifts []CounterDrift, target string, id int64, table string, counters *denormalizedCounters, stored, actual StatsCounters) []CounterDrift {
+	statsTable := target + "_stats"
+	columns := []struct {
+		column string
+		stored int64
+		actual int64
+	}{
+		{table + ".tip", counters.Tip, actual.Tip},
+		{table + ".reactions_count", counters.ReactionsCount, actual.Reactions},
+		{statsTable + ".livecomments", stored.Livecomments, actual.Livecomments},
+		{statsTable + ".tip", stored.Tip, actual.Tip},
+		{statsTable + ".max_tip", stored.MaxTip, actual.MaxTip},
+		{statsTable + ".reactions", stored.Reactions, actual.Reactions},
+		{statsTable + ".reports", stored.Reports, actual.Reports},
+		{statsTable + ".viewers", stored.Viewers, actual.Viewers},
+	}
+	for _, c := range columns {
+		if c.stored != c.actual {
+			drifts = append(drifts, CounterDrift{
+				Target: target,
+				ID:     id,
+				Column: c.column,
+				Stored: c.stored,
+				Actual: c.actual,
+			})
+		}
+	}
+	return drifts
+}
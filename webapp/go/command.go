@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	echolog "github.com/labstack/gommon/log"
+)
+
+// メンテナンス用のサブコマンド
+// 例: ./isupipe repair-livestream-tags, ./isupipe reconcile-stats -dry-run
+func runCommand(args []string) error {
+	conn, err := connectDB(echolog.New("isupipe"))
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "repair-livestream-tags":
+		return repairLivestreamTags(ctx, conn)
+	case "reconcile-stats":
+		return reconcileStats(ctx, conn, args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// repairLivestreamTags は存在しないタグへの紐付けと、同じ配信・タグの重複した紐付けを削除する
+// livestream_tags.sqlのユニーク制約を追加する前に実行する
+func repairLivestreamTags(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "DELETE lt FROM livestream_tags lt LEFT JOIN tags t ON t.id = lt.tag_id WHERE t.id IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to delete livestream tags for unknown tags: %w", err)
+	}
+	phantoms, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// 同じ組み合わせのうち、最も古い行だけを残す
+	query := `
+	DELETE lt FROM livestream_tags lt
+	INNER JOIN livestream_tags keep ON keep.livestream_id = lt.livestream_id AND keep.tag_id = lt.tag_id AND keep.id < lt.id
+	`
+	rs, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to delete duplicated livestream tags: %w", err)
+	}
+	duplicates, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+
+	log.Printf("deleted %d livestream tags for unknown tags, %d duplicated livestream tags", phantoms, duplicates)
+	return nil
+}
+
+// reconcileStats は配信・配信者の統計の集計値を元のテーブルから求め直し、ずれていたものを報告して修正する
+// -dry-runを指定すると報告のみ行う
+func reconcileStats(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("reconcile-stats", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report drift without fixing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 求め直している間に更新された集計値を上書きしないように、先にロックする
+	storedLivestreamStats, storedUserStats, err := getStatsForUpdate(ctx, tx)
+	if err != nil {
+		return err
+	}
+	livestreamStats, userStats, err := computeStats(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	drifts := 0
+	stored := make(map[int64]StatsCounters, len(storedLivestreamStats))
+	for _, s := range storedLivestreamStats {
+		stored[s.LivestreamID] = s.StatsCounters
+	}
+	for _, s := range livestreamStats {
+		if stored[s.LivestreamID] != s.StatsCounters {
+			log.Printf("livestream %d: stored=%+v actual=%+v", s.LivestreamID, stored[s.LivestreamID], s.StatsCounters)
+			drifts++
+		}
+		delete(stored, s.LivestreamID)
+	}
+	// 残ったものは存在しない配信の集計値
+	for livestreamID, s := range stored {
+		log.Printf("livestream %d: stored=%+v but the livestream does not exist", livestreamID, s)
+		drifts++
+	}
+
+	stored = make(map[int64]StatsCounters, len(storedUserStats))
+	for _, s := range storedUserStats {
+		stored[s.UserID] = s.StatsCounters
+	}
+	for _, s := range userStats {
+		if stored[s.UserID] != s.StatsCounters {
+			log.Printf("user %d: stored=%+v actual=%+v", s.UserID, stored[s.UserID], s.StatsCounters)
+			drifts++
+		}
+		delete(stored, s.UserID)
+	}
+	for userID, s := range stored {
+		log.Printf("user %d: stored=%+v but the user does not exist", userID, s)
+		drifts++
+	}
+
+	if *dryRun {
+		log.Printf("found %d drifted stats (dry run)", drifts)
+		return nil
+	}
+
+	if err := replaceStats(ctx, tx, livestreamStats, userStats); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+
+	log.Printf("found and fixed %d drifted stats", drifts)
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+
+	// この件数ごとにレスポンスをフラッシュする
+	exportFlushRows = 1000
+)
+
+// CSVは全ての種類のレコードで共通のヘッダを持ち、typeで種類を区別する
+var exportCSVHeader = []string{"type", "id", "user", "reporter", "livecomment", "comment", "tip", "emoji_name", "created_at", "hidden_at", "hidden_reason"}
+
+// exportRecord はエクスポートする1行。フィールド名はLivecomment, Reaction, LivecommentReportに揃える
+type exportRecord interface {
+	csvRecord() []string
+}
+
+// 配信者の記録として、非表示にしたライブコメントも理由とともに含める
+type livecommentExportRecord struct {
+	Type         string `db:"-" json:"type"`
+	ID           int64  `db:"id" json:"id"`
+	User         string `db:"user" json:"user"`
+	Comment      string `db:"comment" json:"comment"`
+	Tip          int64  `db:"tip" json:"tip"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+	HiddenAt     *int64 `db:"hidden_at" json:"hidden_at,omitempty"`
+	HiddenReason string `db:"hidden_reason" json:"hidden_reason,omitempty"`
+}
+
+func (r *livecommentExportRecord) csvRecord() []string {
+	hiddenAt := ""
+	if r.HiddenAt != nil {
+		hiddenAt = strconv.FormatInt(*r.HiddenAt, 10)
+	}
+	return []string{r.Type, strconv.FormatInt(r.ID, 10), r.User, "", "", r.Comment, strconv.FormatInt(r.Tip, 10), "", strconv.FormatInt(r.CreatedAt, 10), hiddenAt, r.HiddenReason}
+}
+
+type reactionExportRecord struct {
+	Type      string `db:"-" json:"type"`
+	ID        int64  `db:"id" json:"id"`
+	EmojiName string `db:"emoji_name" json:"emoji_name"`
+	User      string `db:"user" json:"user"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+func (r *reactionExportRecord) csvRecord() []string {
+	return []string{r.Type, strconv.FormatInt(r.ID, 10), r.User, "", "", "", "", r.EmojiName, strconv.FormatInt(r.CreatedAt, 10), "", ""}
+}
+
+type livecommentReportExportRecord struct {
+	Type        string `db:"-" json:"type"`
+	ID          int64  `db:"id" json:"id"`
+	Reporter    string `db:"reporter" json:"reporter"`
+	Livecomment int64  `db:"livecomment" json:"livecomment"`
+	CreatedAt   int64  `db:"created_at" json:"created_at"`
+}
+
+func (r *livecommentReportExportRecord) csvRecord() []string {
+	return []string{r.Type, strconv.FormatInt(r.ID, 10), "", r.Reporter, strconv.FormatInt(r.Livecomment, 10), "", "", "", strconv.FormatInt(r.CreatedAt, 10), "", ""}
+}
+
+type exportSource struct {
+	query     string
+	newRecord func() exportRecord
+}
+
+// includeで指定できる名前と、その取得方法
+var exportSources = map[string]exportSource{
+	"livecomments": {
+		query: "SELECT lc.id, u.name AS user, lc.comment, lc.tip, lc.created_at, lc.hidden_at, lc.hidden_reason FROM livecomments lc INNER JOIN users u ON u.id = lc.user_id WHERE lc.livestream_id = ? ORDER BY lc.id",
+		newRecord: func() exportRecord {
+			return &livecommentExportRecord{Type: "livecomment"}
+		},
+	},
+	"reactions": {
+		query: "SELECT r.id, r.emoji_name, u.name AS user, r.created_at FROM reactions r INNER JOIN users u ON u.id = r.user_id WHERE r.livestream_id = ? ORDER BY r.id",
+		newRecord: func() exportRecord {
+			return &reactionExportRecord{Type: "reaction"}
+		},
+	},
+	"reports": {
+		query: "SELECT rp.id, u.name AS reporter, rp.livecomment_id AS livecomment, rp.created_at FROM livecomment_reports rp INNER JOIN users u ON u.id = rp.user_id WHERE rp.livestream_id = ? ORDER BY rp.id",
+		newRecord: func() exportRecord {
+			return &livecommentReportExportRecord{Type: "livecomment_report"}
+		},
+	},
+}
+
+var defaultExportIncludes = []string{"livecomments", "reactions", "reports"}
+
+type exportWriter interface {
+	write(record exportRecord) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvExportWriter) write(record exportRecord) error {
+	return w.w.Write(record.csvRecord())
+}
+
+func (w *csvExportWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type jsonlExportWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlExportWriter) write(record exportRecord) error {
+	// Encodeは末尾に改行を付ける
+	return w.enc.Encode(record)
+}
+
+func (w *jsonlExportWriter) flush() error {
+	return nil
+}
+
+// 配信のエクスポートAPI
+// 配信者のみ取得できる。行はDBから読みながらそのまま書き出す
+// GET /api/livestream/:livestream_id/export
+func exportLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	format := exportFormatCSV
+	if c.QueryParam("format") != "" {
+		format = c.QueryParam("format")
+	}
+	var contentType string
+	switch format {
+	case exportFormatCSV:
+		contentType = "text/csv; charset=utf-8"
+	case exportFormatJSONL:
+		contentType = "application/x-ndjson; charset=utf-8"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "format query parameter must be one of csv, jsonl")
+	}
+
+	includes := defaultExportIncludes
+	if c.QueryParam("include") != "" {
+		// 同じ種類を重複して指定しても一度だけ出力する
+		includes = nil
+		seen := make(map[string]struct{})
+		for _, include := range strings.Split(c.QueryParam("include"), ",") {
+			if _, ok := exportSources[include]; !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "include query parameter must be comma separated list of livecomments, reactions, reports")
+			}
+			if _, ok := seen[include]; ok {
+				continue
+			}
+			seen[include] = struct{}{}
+			includes = append(includes, include)
+		}
+	}
+
+	// 全ての種類のレコードを同じスナップショットから読むため、1つのトランザクションで取得する
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't export other streamer's livestream")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"livestream-%d.%s\"", livestreamID, format))
+	res.WriteHeader(http.StatusOK)
+
+	// ここから先はステータスコードを送信済みなので、エラーはログに残るのみ
+	var w exportWriter
+	if format == exportFormatCSV {
+		cw := csv.NewWriter(res)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return err
+		}
+		w = &csvExportWriter{w: cw}
+	} else {
+		w = &jsonlExportWriter{enc: json.NewEncoder(res)}
+	}
+
+	for _, include := range includes {
+		if err := writeExportRows(ctx, tx, res, w, exportSources[include], livestreamID); err != nil {
+			return fmt.Errorf("failed to export %s: %w", include, err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	res.Flush()
+
+	return tx.Commit()
+}
+
+func writeExportRows(ctx context.Context, tx *sqlx.Tx, res *echo.Response, w exportWriter, source exportSource, livestreamID int64) error {
+	rows, err := tx.QueryxContext(ctx, source.query, livestreamID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		record := source.newRecord()
+		if err := rows.StructScan(record); err != nil {
+			return err
+		}
+		if err := w.write(record); err != nil {
+			return err
+		}
+		n++
+		if n%exportFlushRows == 0 {
+			if err := w.flush(); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+	}
+	return rows.Err()
+}
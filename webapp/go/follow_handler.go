@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	ID         int64 `db:"id"`
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+// 配信者フォローAPI
+// POST /api/user/:username/follow
+func followUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee := UserModel{}
+	if err := tx.GetContext(ctx, &followee, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if followee.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	followModel := FollowModel{
+		FollowerID: userID,
+		FolloweeID: followee.ID,
+		CreatedAt:  time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (:follower_id, :followee_id, :created_at)", followModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+	followed, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	// 既にフォロー済みの場合は何もしない
+	if followed > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET followers_count = followers_count + 1 WHERE id = ?", followee.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to increment followers_count: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET following_count = following_count + 1 WHERE id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to increment following_count: "+err.Error())
+		}
+		followee.FollowersCount++
+	}
+
+	user, err := fillUserResponse(ctx, tx, followee)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// 配信者フォロー解除API
+// DELETE /api/user/:username/follow
+func unfollowUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee := UserModel{}
+	if err := tx.GetContext(ctx, &followee, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+	unfollowed, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	// フォローしていなかった場合は何もしない
+	if unfollowed > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET followers_count = followers_count - 1 WHERE id = ?", followee.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decrement followers_count: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET following_count = following_count - 1 WHERE id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decrement following_count: "+err.Error())
+		}
+		followee.FollowersCount--
+	}
+
+	user, err := fillUserResponse(ctx, tx, followee)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// フォロー中の配信者の配信中・配信予定の一覧API
+// 配信中のものを先頭に、開始日時が近い順に返す
+// GET /api/feed
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT l.* FROM livestreams l
+	INNER JOIN follows f ON f.followee_id = l.user_id
+	WHERE f.follower_id = ? AND l.status IN (?, ?) AND l.end_at > ?
+	ORDER BY (l.status = ? OR l.start_at <= ?) DESC, l.start_at ASC, l.id ASC
+	`
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	var livestreamModels []*LivestreamModel
+	now := time.Now().Unix()
+	if err := tx.SelectContext(ctx, &livestreamModels, query, userID, livestreamStatusLive, livestreamStatusScheduled, now, livestreamStatusLive, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
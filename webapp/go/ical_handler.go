@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	icalendarTimeFormat = "20060102T150405Z"
+	// RFC 5545 3.1: 1行は75オクテットまで
+	icalendarMaxLineOctets = 75
+	// UIDはリクエストのHostによらず同じ値にする
+	icalendarUIDDomain = "u.isucon.dev"
+)
+
+// 配信者の配信予定をiCalendar形式で返すAPI
+// GET /api/user/:username/livestream.ics
+func getUserLivestreamsCalendarHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+
+	var user UserModel
+	if err := dbConn.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// 取り消された配信もSTATUS:CANCELLEDとして含め、購読中のカレンダーから消えるようにする
+	now := time.Now()
+	var livestreamModels []*LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND end_at > ? ORDER BY start_at", user.ID, now.Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	host := c.Request().Host
+	dtstamp := now.UTC().Format(icalendarTimeFormat)
+
+	var b strings.Builder
+	writeICalendarLine(&b, "BEGIN:VCALENDAR")
+	writeICalendarLine(&b, "VERSION:2.0")
+	writeICalendarLine(&b, "PRODID:-//ISUCON//isupipe//JA")
+	writeICalendarLine(&b, "CALSCALE:GREGORIAN")
+	writeICalendarLine(&b, "METHOD:PUBLISH")
+	writeICalendarLine(&b, "X-WR-CALNAME:"+escapeICalendarText(user.DisplayName))
+	for _, livestream := range livestreamModels {
+		status := "CONFIRMED"
+		if livestream.Status == livestreamStatusCancelled {
+			status = "CANCELLED"
+		}
+		writeICalendarLine(&b, "BEGIN:VEVENT")
+		writeICalendarLine(&b, fmt.Sprintf("UID:livestream-%d@%s", livestream.ID, icalendarUIDDomain))
+		writeICalendarLine(&b, fmt.Sprintf("SEQUENCE:%d", livestream.Sequence))
+		writeICalendarLine(&b, "DTSTAMP:"+dtstamp)
+		writeICalendarLine(&b, "DTSTART:"+time.Unix(livestream.StartAt, 0).UTC().Format(icalendarTimeFormat))
+		writeICalendarLine(&b, "DTEND:"+time.Unix(livestream.EndAt, 0).UTC().Format(icalendarTimeFormat))
+		writeICalendarLine(&b, "SUMMARY:"+escapeICalendarText(livestream.Title))
+		writeICalendarLine(&b, "DESCRIPTION:"+escapeICalendarText(livestream.Description))
+		writeICalendarLine(&b, fmt.Sprintf("URL:https://%s/livestream/%d", host, livestream.ID))
+		writeICalendarLine(&b, "STATUS:"+status)
+		writeICalendarLine(&b, "END:VEVENT")
+	}
+	writeICalendarLine(&b, "END:VCALENDAR")
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(b.String()))
+}
+
+// writeICalendarLine は1行を75オクテットごとに折り返し、CRLFで終端して書き込む
+func writeICalendarLine(b *strings.Builder, line string) {
+	limit := icalendarMaxLineOctets
+	for len(line) > limit {
+		// マルチバイト文字の途中で折り返さない
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// 継続行は先頭の空白の分だけ短くする
+		limit = icalendarMaxLineOctets - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+var icalendarTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+// RFC 5545 3.3.11: TEXT値のエスケープ
+func escapeICalendarText(s string) string {
+	return icalendarTextEscaper.Replace(s)
+}
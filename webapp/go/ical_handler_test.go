@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWriteICalendarLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		// 折り返した行数
+		wantLines int
+	}{
+		{name: "empty", line: "", wantLines: 1},
+		{name: "short", line: "SUMMARY:hello", wantLines: 1},
+		{name: "exactly 75 octets", line: strings.Repeat("a", 75), wantLines: 1},
+		{name: "76 octets", line: strings.Repeat("a", 76), wantLines: 2},
+		{name: "continuation line is 74 octets", line: strings.Repeat("a", 75+74), wantLines: 2},
+		{name: "continuation line overflows", line: strings.Repeat("a", 75+75), wantLines: 3},
+		// 3オクテットの文字が75オクテット目をまたぐ
+		{name: "multibyte across boundary", line: "SUMMARY:" + strings.Repeat("あ", 30), wantLines: 2},
+		{name: "multibyte only", line: strings.Repeat("配", 100), wantLines: 5},
+		// 4オクテットの文字
+		{name: "emoji", line: "DESCRIPTION:" + strings.Repeat("🎤", 40), wantLines: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			writeICalendarLine(&b, tt.line)
+			got := b.String()
+
+			if !strings.HasSuffix(got, "\r\n") {
+				t.Fatalf("line must end with CRLF: %q", got)
+			}
+			lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+			if len(lines) != tt.wantLines {
+				t.Errorf("got %d lines, want %d", len(lines), tt.wantLines)
+			}
+			for i, line := range lines {
+				if len(line) > icalendarMaxLineOctets {
+					t.Errorf("line %d has %d octets", i, len(line))
+				}
+				if i > 0 {
+					if !strings.HasPrefix(line, " ") {
+						t.Errorf("continuation line %d must start with a space: %q", i, line)
+					}
+					line = line[1:]
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line %d splits a multibyte character: %q", i, line)
+				}
+			}
+
+			// 折り返しを戻すと元の行になる
+			if unfolded := strings.ReplaceAll(strings.TrimSuffix(got, "\r\n"), "\r\n ", ""); unfolded != tt.line {
+				t.Errorf("unfolded = %q, want %q", unfolded, tt.line)
+			}
+		})
+	}
+}
+
+func TestEscapeICalendarText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "plain", want: "plain"},
+		{in: `a\b`, want: `a\\b`},
+		{in: "a;b,c", want: `a\;b\,c`},
+		{in: "line1\r\nline2\nline3\rline4", want: `line1\nline2\nline3\nline4`},
+	}
+	for _, tt := range tests {
+		if got := escapeICalendarText(tt.in); got != tt.want {
+			t.Errorf("escapeICalendarText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
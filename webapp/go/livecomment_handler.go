@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -28,6 +27,10 @@ type LivecommentModel struct {
 	Comment      string `db:"comment"`
 	Tip          int64  `db:"tip"`
 	CreatedAt    int64  `db:"created_at"`
+	// モデレーションで非表示にした日時と配信者、理由
+	HiddenAt     sql.NullInt64 `db:"hidden_at"`
+	HiddenBy     sql.NullInt64 `db:"hidden_by"`
+	HiddenReason string        `db:"hidden_reason"`
 }
 
 type Livecomment struct {
@@ -37,6 +40,9 @@ type Livecomment struct {
 	Comment    string     `json:"comment"`
 	Tip        int64      `json:"tip"`
 	CreatedAt  int64      `json:"created_at"`
+	// 非表示のライブコメントのみ
+	HiddenAt     *int64 `json:"hidden_at,omitempty"`
+	HiddenReason string `json:"hidden_reason,omitempty"`
 }
 
 type LivecommentReport struct {
@@ -85,7 +91,26 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	// 非表示のライブコメントは配信者がinclude_hiddenを指定した場合のみ返す
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND hidden_at IS NULL ORDER BY created_at DESC"
+	if c.QueryParam("include_hidden") == "true" {
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+
+		var ownerID int64
+		if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		if ownerID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "only the streamer can get hidden livecomments")
+		}
+		query = "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	}
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
@@ -156,10 +181,7 @@ func getLivecommentsHandler(c echo.Context) error {
 		for _, user := range userModels {
 			theme := Theme{}
 			if userThemes, ok := themesByUserID[user.ID]; ok && len(userThemes) > 0 {
-				theme = Theme{
-					ID:       userThemes[0].ID,
-					DarkMode: userThemes[0].DarkMode,
-				}
+				theme = fillThemeResponse(userThemes[0])
 			}
 
 			iconHash := "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
@@ -168,12 +190,14 @@ func getLivecommentsHandler(c echo.Context) error {
 			}
 
 			users[user.ID] = User{
-				ID:          user.ID,
-				Name:        user.Name,
-				DisplayName: user.DisplayName,
-				Description: user.Description,
-				Theme:       theme,
-				IconHash:    iconHash,
+				ID:             user.ID,
+				Name:           user.Name,
+				DisplayName:    user.DisplayName,
+				Description:    user.Description,
+				Theme:          theme,
+				IconHash:       iconHash,
+				FollowersCount: user.FollowersCount,
+				FollowingCount: user.FollowingCount,
 			}
 		}
 
@@ -191,12 +215,14 @@ func getLivecommentsHandler(c echo.Context) error {
 	livecomments := make([]Livecomment, len(livecommentModels))
 	for i, livecommentModel := range livecommentModels {
 		livecomments[i] = Livecomment{
-			ID:         livecommentModel.ID,
-			User:       users[livecommentModel.UserID],
-			Livestream: livestream,
-			Comment:    livecommentModel.Comment,
-			Tip:        livecommentModel.Tip,
-			CreatedAt:  livecommentModel.CreatedAt,
+			ID:           livecommentModel.ID,
+			User:         users[livecommentModel.UserID],
+			Livestream:   livestream,
+			Comment:      livecommentModel.Comment,
+			Tip:          livecommentModel.Tip,
+			CreatedAt:    livecommentModel.CreatedAt,
+			HiddenAt:     nullInt64Pointer(livecommentModel.HiddenAt),
+			HiddenReason: livecommentModel.HiddenReason,
 		}
 	}
 
@@ -283,17 +309,17 @@ func postLivecommentHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	if err := checkLivestreamOpen(livestreamModel, time.Now().Unix()); err != nil {
+		return err
+	}
 
 	// スパム判定
-	var words []string
-	if err := tx.SelectContext(ctx, &words, "SELECT word FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
+	matcher, err := ngWordMatchers.get(ctx, int64(livestreamID))
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
-
-	for _, word := range words {
-		if strings.Contains(req.Comment, word) {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
-		}
+	if _, ok := matcher.find(req.Comment); ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 	}
 
 	now := time.Now().Unix()
@@ -341,7 +367,7 @@ func postLivecommentHandler(c echo.Context) error {
 
 	tags := make([]Tag, len(tagIDs))
 	if len(tagIDs) > 0 {
-		query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
+		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query for tags: "+err.Error())
 		}
@@ -361,6 +387,8 @@ func postLivecommentHandler(c echo.Context) error {
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		Status:       livestreamEffectiveStatus(livestreamModel, time.Now().Unix()),
+		SeriesID:     nullInt64Pointer(livestreamModel.SeriesID),
 	}
 
 	livecomment := Livecomment{
@@ -372,6 +400,15 @@ func postLivecommentHandler(c echo.Context) error {
 		CreatedAt:  livecommentModel.CreatedAt,
 	}
 
+	// 配信と配信者の集計値を更新
+	if err := addStats(ctx, tx, livestreamModel.ID, livestreamModel.UserID, StatsCounters{
+		Livecomments: 1,
+		Tip:          req.Tip,
+		MaxTip:       req.Tip,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update stats: "+err.Error())
+	}
+
 	if req.Tip > 0 {
 		// livestreamのtipにlivecommentのtipを加算
 		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET tip = tip + ? WHERE id = ?", req.Tip, livestreamID); err != nil {
@@ -381,12 +418,39 @@ func postLivecommentHandler(c echo.Context) error {
 		if _, err := tx.ExecContext(ctx, "UPDATE users SET tip = tip + ? WHERE id = ?", req.Tip, livestreamModel.UserID); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user tip: "+err.Error())
 		}
+		// 配信者にチップを受け取ったことを通知
+		if err := insertNotification(ctx, tx, &NotificationModel{
+			UserID:        livestreamModel.UserID,
+			Type:          notificationTypeTipReceived,
+			ActorID:       sql.NullInt64{Int64: userID, Valid: true},
+			LivestreamID:  sql.NullInt64{Int64: livestreamModel.ID, Valid: true},
+			LivecommentID: sql.NullInt64{Int64: livecommentID, Valid: true},
+			Tip:           req.Tip,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// 配信者のWebhookに送信
+	if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventLivecomment, livecomment); err != nil {
+		return err
+	}
+	if req.Tip > 0 {
+		if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventTip, livecomment); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	trending.record(time.Unix(livecommentModel.CreatedAt, 0), livestreamModel.ID, tagIDs, livecommentTrendingPoints(livecommentModel.Tip))
+	if req.Tip > 0 {
+		livestreamRankingIndex.add(livestreamModel.ID, req.Tip)
+		userRankingIndex.add(livestreamModel.UserID, req.Tip)
+	}
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
@@ -428,7 +492,7 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 
 	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND hidden_at IS NULL", livecommentID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
 		} else {
@@ -453,10 +517,30 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	reportModel.ID = reportID
 
+	if err := addStats(ctx, tx, livestreamModel.ID, livestreamModel.UserID, StatsCounters{Reports: 1}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update stats: "+err.Error())
+	}
+
+	// コメント投稿者に報告されたことを通知
+	if err := insertNotification(ctx, tx, &NotificationModel{
+		UserID:        livecommentModel.UserID,
+		Type:          notificationTypeLivecommentReported,
+		LivestreamID:  sql.NullInt64{Int64: livestreamModel.ID, Valid: true},
+		LivecommentID: sql.NullInt64{Int64: livecommentModel.ID, Valid: true},
+	}); err != nil {
+		return err
+	}
+
 	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 	}
+
+	// 配信者のWebhookに送信
+	if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, webhookEventReport, report); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
@@ -518,25 +602,53 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
 
+	// 追加したNGワードのみで、表示中のライブコメントを照合する
+	// 既存のNGワードで照合し直すと、配信者が復元したライブコメントを再び非表示にしてしまう
+	matcher := newNGWordMatcher([]*NGWord{{ID: wordID, Word: req.NGWord}}, ngWordNormalizationConfig)
 	var livecomments []*LivecommentModel
-	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT id, livestream_id, comment, tip, created_at FROM livecomments WHERE livestream_id = ? AND hidden_at IS NULL", livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
+	// NGワードに一致したライブコメントは削除せずに非表示にし、その分を集計値から引く
+	now := time.Now().Unix()
+	var hidden StatsCounters
+	var hiddenIDs []int64
+	var hiddenLivecomments []*LivecommentModel
+	var logModels []*LivecommentModerationLogModel
 	for _, livecomment := range livecomments {
-		query := `
-		DELETE FROM livecomments
-		WHERE
-		id = ? AND
-		(SELECT COUNT(*)
-		FROM
-		(SELECT ? AS text) AS texts
-		INNER JOIN
-		(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-		ON texts.text LIKE patterns.pattern) >= 1;
-		`
-		if _, err := tx.ExecContext(ctx, query, livecomment.ID, livecomment.Comment, req.NGWord); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+		matchedWordID, ok := matcher.find(livecomment.Comment)
+		if !ok {
+			continue
+		}
+		hiddenIDs = append(hiddenIDs, livecomment.ID)
+		hiddenLivecomments = append(hiddenLivecomments, livecomment)
+		logModels = append(logModels, &LivecommentModerationLogModel{
+			LivecommentID: livecomment.ID,
+			LivestreamID:  livecomment.LivestreamID,
+			UserID:        userID,
+			Action:        moderationActionHide,
+			Reason:        moderationReasonNGWord,
+			NGWordID:      sql.NullInt64{Int64: matchedWordID, Valid: true},
+			CreatedAt:     now,
+		})
+		hidden.Livecomments--
+		hidden.Tip -= livecomment.Tip
+	}
+	if err := hideLivecomments(ctx, tx, hiddenIDs, userID, moderationReasonNGWord, now); err != nil {
+		return err
+	}
+	if err := insertModerationLogs(ctx, tx, logModels); err != nil {
+		return err
+	}
+	ownerID := ownedLivestreams[0].UserID
+	if err := adjustLivecommentCounters(ctx, tx, int64(livestreamID), ownerID, hidden); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update counters: "+err.Error())
+	}
+	var tagIDs []int64
+	if len(hiddenLivecomments) > 0 {
+		if err := tx.SelectContext(ctx, &tagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
 		}
 	}
 
@@ -544,6 +656,16 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	ngWordMatchers.invalidate(int64(livestreamID))
+	// 非表示にしたライブコメントの分をランキングとトレンドから差し引く
+	if hidden.Tip != 0 {
+		livestreamRankingIndex.add(int64(livestreamID), hidden.Tip)
+		userRankingIndex.add(ownerID, hidden.Tip)
+	}
+	for _, livecomment := range hiddenLivecomments {
+		trending.unrecord(time.Unix(livecomment.CreatedAt, 0), int64(livestreamID), tagIDs, livecommentTrendingPoints(livecomment.Tip))
+	}
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
 	})
@@ -569,12 +691,14 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 	}
 
 	livecomment := Livecomment{
-		ID:         livecommentModel.ID,
-		User:       commentOwner,
-		Livestream: livestream,
-		Comment:    livecommentModel.Comment,
-		Tip:        livecommentModel.Tip,
-		CreatedAt:  livecommentModel.CreatedAt,
+		ID:           livecommentModel.ID,
+		User:         commentOwner,
+		Livestream:   livestream,
+		Comment:      livecommentModel.Comment,
+		Tip:          livecommentModel.Tip,
+		CreatedAt:    livecommentModel.CreatedAt,
+		HiddenAt:     nullInt64Pointer(livecommentModel.HiddenAt),
+		HiddenReason: livecommentModel.HiddenReason,
 	}
 
 	return livecomment, nil
@@ -15,6 +15,23 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// 1配信に付与できるタグの上限
+const maxLivestreamTags = 10
+
+// 配信の状態
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+	livestreamStatusCancelled = "cancelled"
+)
+
+// 状態ごとに遷移可能な次の状態
+var livestreamStatusTransitions = map[string][]string{
+	livestreamStatusScheduled: {livestreamStatusLive, livestreamStatusCancelled},
+	livestreamStatusLive:      {livestreamStatusEnded},
+}
+
 type ReserveLivestreamRequest struct {
 	Tags         []int64 `json:"tags"`
 	Title        string  `json:"title"`
@@ -23,6 +40,8 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// 指定された場合は繰り返し予約として扱う
+	Recurrence *ReservationRecurrence `json:"recurrence,omitempty"`
 }
 
 type LivestreamViewerModel struct {
@@ -42,6 +61,12 @@ type LivestreamModel struct {
 	EndAt          int64  `db:"end_at" json:"end_at"`
 	Tip            int64  `db:"tip"`
 	ReactionsCount int64  `db:"reactions_count"`
+	PeakViewers    int64  `db:"peak_viewers"`
+	Status         string `db:"status" json:"status"`
+	// 繰り返し予約で作成された配信のみ設定される
+	SeriesID sql.NullInt64 `db:"series_id" json:"-"`
+	// 配信内容や状態を変更するたびに増える版番号 (iCalendarのSEQUENCE)
+	Sequence int64 `db:"sequence" json:"-"`
 }
 
 type Livestream struct {
@@ -54,6 +79,8 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	Status       string `json:"status"`
+	SeriesID     *int64 `json:"series_id,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -100,52 +127,121 @@ func reserveLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	// 設定された予約可能期間内で、予約枠の境界に揃っているかチェック
+	if err := validateReservationRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	// 存在しないタグや重複したタグを付与しないようにする
+	tagIDs, err := normalizeLivestreamTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return err
+	}
+
+	// 繰り返し予約の場合は、全ての回をまとめて予約する
+	if req.Recurrence != nil {
+		return reserveRecurringLivestreams(c, tx, userID, req, tagIDs)
 	}
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
+	if err := consumeReservationSlots(ctx, tx, req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	livestreamModel := &LivestreamModel{
+		UserID:       int64(userID),
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		Status:       livestreamStatusScheduled,
+	}
+	if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+		return err
+	}
+
+	// フォロワーに配信予約を通知する
+	if err := notifyFollowers(ctx, tx, notificationTypeLivestreamReserved, *livestreamModel); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
+	addLivestreamsToRanking([]*LivestreamModel{livestreamModel})
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// normalizeLivestreamTagIDs は予約時に指定されたタグIDの重複を除き、
+// 廃止されていない既存のタグであることを検証する
+func normalizeLivestreamTagIDs(ctx context.Context, tx *sqlx.Tx, tagIDs []int64) ([]int64, error) {
+	seen := make(map[int64]struct{}, len(tagIDs))
+	uniqueTagIDs := make([]int64, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		if _, ok := seen[tagID]; ok {
+			continue
 		}
-	)
+		seen[tagID] = struct{}{}
+		uniqueTagIDs = append(uniqueTagIDs, tagID)
+	}
+	if len(uniqueTagIDs) > maxLivestreamTags {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a livestream can have at most %d tags", maxLivestreamTags))
+	}
+	if len(uniqueTagIDs) == 0 {
+		return uniqueTagIDs, nil
+	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	activeTagIDs, err := filterActiveTagIDs(ctx, tx, uniqueTagIDs)
+	if err != nil {
+		return nil, err
 	}
+	if len(activeTagIDs) != len(uniqueTagIDs) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "tags contain unknown or retired tag id")
+	}
+
+	return uniqueTagIDs, nil
+}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+// filterActiveTagIDs は重複のないタグIDから、存在して廃止されていないものだけを順序を保って返す
+func filterActiveTagIDs(ctx context.Context, tx *sqlx.Tx, tagIDs []int64) ([]int64, error) {
+	if len(tagIDs) == 0 {
+		return tagIDs, nil
+	}
+
+	query, args, err := sqlx.In("SELECT id FROM tags WHERE id IN (?) AND retired_at IS NULL", tagIDs)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for tags: "+err.Error())
+	}
+	var existingTagIDs []int64
+	if err := tx.SelectContext(ctx, &existingTagIDs, tx.Rebind(query), args...); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	existing := make(map[int64]struct{}, len(existingTagIDs))
+	for _, tagID := range existingTagIDs {
+		existing[tagID] = struct{}{}
+	}
+
+	activeTagIDs := make([]int64, 0, len(existingTagIDs))
+	for _, tagID := range tagIDs {
+		if _, ok := existing[tagID]; ok {
+			activeTagIDs = append(activeTagIDs, tagID)
+		}
+	}
+	return activeTagIDs, nil
+}
+
+// insertLivestream は配信とタグの紐付けを登録し、livestreamModel.IDを設定する
+func insertLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, tagIDs []int64) error {
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, status, series_id) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :status, :series_id)", livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
@@ -157,7 +253,7 @@ func reserveLivestreamHandler(c echo.Context) error {
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	for _, tagID := range req.Tags {
+	for _, tagID := range tagIDs {
 		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
@@ -166,16 +262,7 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusCreated, livestream)
+	return nil
 }
 
 func searchLivestreamsHandler(c echo.Context) error {
@@ -190,13 +277,17 @@ func searchLivestreamsHandler(c echo.Context) error {
 
 	var livestreamModels []*LivestreamModel
 	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagID int
-		if err := tx.GetContext(ctx, &tagID, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
+		// タグによる取得 (エイリアスと子タグも含める)
+		tagIDs, err := getSearchTagIDs(ctx, tx, keyTagName)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
 		}
+		query, params, err := sqlx.In("SELECT DISTINCT livestream_id FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
 		var keyTaggedLivestreamIDs []int64
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreamIDs, "SELECT livestream_id FROM livestream_tags WHERE tag_id = ? ORDER BY livestream_id DESC", tagID); err != nil {
+		if err := tx.SelectContext(ctx, &keyTaggedLivestreamIDs, query, params...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreamIDs: "+err.Error())
 		}
 
@@ -226,6 +317,24 @@ func searchLivestreamsHandler(c echo.Context) error {
 		}
 	}
 
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// fillLivestreamsResponse は複数の配信について、タグや配信者をまとめて取得してレスポンスを組み立てる
+func fillLivestreamsResponse(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel) ([]Livestream, error) {
+	if len(livestreamModels) == 0 {
+		return []Livestream{}, nil
+	}
+
 	livestreamIDs := make([]int64, len(livestreamModels))
 	for i, livestreamModel := range livestreamModels {
 		livestreamIDs[i] = livestreamModel.ID
@@ -235,11 +344,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 	var livestreamTags []LivestreamTagModel
 	query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for tags: "+err.Error())
+		return nil, err
 	}
 	query = tx.Rebind(query)
 	if err := tx.SelectContext(ctx, &livestreamTags, query, args...); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+		return nil, err
 	}
 
 	// Group tags by livestream ID
@@ -255,13 +364,13 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	var tags []Tag
 	if len(tagIDs) > 0 {
-		query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
+		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for tags: "+err.Error())
+			return nil, err
 		}
 		query = tx.Rebind(query)
 		if err := tx.SelectContext(ctx, &tags, query, args...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+			return nil, err
 		}
 	}
 
@@ -279,11 +388,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 	var users []UserModel
 	query, args, err = sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for users: "+err.Error())
+		return nil, err
 	}
 	query = tx.Rebind(query)
 	if err := tx.SelectContext(ctx, &users, query, args...); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		return nil, err
 	}
 
 	// Map users by ID for quick lookup
@@ -296,11 +405,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 	var themes []ThemeModel
 	query, args, err = sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for themes: "+err.Error())
+		return nil, err
 	}
 	query = tx.Rebind(query)
 	if err := tx.SelectContext(ctx, &themes, query, args...); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get themes: "+err.Error())
+		return nil, err
 	}
 
 	// Map themes by user ID for quick lookup
@@ -313,11 +422,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 	var icons []IconModel
 	query, args, err = sqlx.In("SELECT id, user_id, icon_hash FROM icons WHERE user_id IN (?)", userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for icons: "+err.Error())
+		return nil, err
 	}
 	query = tx.Rebind(query)
 	if err := tx.SelectContext(ctx, &icons, query, args...); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icons: "+err.Error())
+		return nil, err
 	}
 
 	// Map icons by user ID for quick lookup
@@ -330,10 +439,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 	for _, user := range users {
 		theme := Theme{}
 		if userThemes, ok := themesByUserID[user.ID]; ok && len(userThemes) > 0 {
-			theme = Theme{
-				ID:       userThemes[0].ID,
-				DarkMode: userThemes[0].DarkMode,
-			}
+			theme = fillThemeResponse(userThemes[0])
 		}
 
 		iconHash := "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
@@ -342,18 +448,21 @@ func searchLivestreamsHandler(c echo.Context) error {
 		}
 
 		owner := User{
-			ID:          user.ID,
-			Name:        user.Name,
-			DisplayName: user.DisplayName,
-			Description: user.Description,
-			Theme:       theme,
-			IconHash:    iconHash,
+			ID:             user.ID,
+			Name:           user.Name,
+			DisplayName:    user.DisplayName,
+			Description:    user.Description,
+			Theme:          theme,
+			IconHash:       iconHash,
+			FollowersCount: user.FollowersCount,
+			FollowingCount: user.FollowingCount,
 		}
 
 		owners[user.ID] = owner
 	}
 
 	// Construct the response
+	now := time.Now().Unix()
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i, livestreamModel := range livestreamModels {
 		owner := owners[livestreamModel.UserID]
@@ -374,14 +483,12 @@ func searchLivestreamsHandler(c echo.Context) error {
 			Tags:         livestreamTags,
 			StartAt:      livestreamModel.StartAt,
 			EndAt:        livestreamModel.EndAt,
+			Status:       livestreamEffectiveStatus(*livestreamModel, now),
+			SeriesID:     nullInt64Pointer(livestreamModel.SeriesID),
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusOK, livestreams)
+	return livestreams, nil
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -488,15 +595,38 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	now := time.Now()
+	if err := checkLivestreamOpen(livestreamModel, now.Unix()); err != nil {
+		return err
+	}
+
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    now.Unix(),
 	}
 
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	if err := addStats(ctx, tx, livestreamModel.ID, livestreamModel.UserID, StatsCounters{Viewers: 1}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update stats: "+err.Error())
+	}
+
+	// 以降はハートビートで視聴を継続する
+	if _, err := touchWatchSession(ctx, tx, userID, int64(livestreamID), now); err != nil {
+		return err
+	}
+	if _, err := updateLivestreamViewers(ctx, tx, int64(livestreamID), now); err != nil {
+		return err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -528,9 +658,26 @@ func exitLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
+	exited, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if exited > 0 {
+		var ownerID int64
+		if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		if err := addStats(ctx, tx, int64(livestreamID), ownerID, StatsCounters{Viewers: -exited}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update stats: "+err.Error())
+		}
+	}
+	if err := endWatchSession(ctx, tx, userID, int64(livestreamID), time.Now()); err != nil {
+		return err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -539,6 +686,145 @@ func exitLivestreamHandler(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// 配信開始API
+// POST /api/livestream/:livestream_id/start
+func startLivestreamHandler(c echo.Context) error {
+	return transitionLivestreamStatus(c, livestreamStatusLive)
+}
+
+// 配信終了API
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return transitionLivestreamStatus(c, livestreamStatusEnded)
+}
+
+// 配信予約取り消しAPI
+// POST /api/livestream/:livestream_id/cancel
+func cancelLivestreamHandler(c echo.Context) error {
+	return transitionLivestreamStatus(c, livestreamStatusCancelled)
+}
+
+// transitionLivestreamStatus は配信者自身の配信を次の状態に遷移させる
+func transitionLivestreamStatus(c echo.Context, nextStatus string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't change the status of other streamer's livestream")
+	}
+
+	// 予約時間を過ぎた配信は遷移させない
+	currentStatus := livestreamEffectiveStatus(livestreamModel, time.Now().Unix())
+	allowed := false
+	for _, status := range livestreamStatusTransitions[currentStatus] {
+		if status == nextStatus {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("livestream can't transition from %s to %s", currentStatus, nextStatus))
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ?, sequence = sequence + 1 WHERE id = ?", nextStatus, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+	}
+	livestreamModel.Status = nextStatus
+
+	// フォロワーに配信開始を通知する
+	if nextStatus == livestreamStatusLive {
+		if err := notifyFollowers(ctx, tx, notificationTypeLivestreamStarted, livestreamModel); err != nil {
+			return err
+		}
+	}
+
+	// 取り消された配信の予約枠を返却する
+	var bookedLivestreamModels []*LivestreamModel
+	if nextStatus == livestreamStatusCancelled {
+		bookedLivestreamModels, err = releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addLivestreamsToRanking(bookedLivestreamModels)
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// livestreamEffectiveStatus は配信の現在の状態を返す
+// statusは配信者の操作でのみ更新されるので、一度も遷移していない配信は予約時間から状態を決める
+func livestreamEffectiveStatus(livestreamModel LivestreamModel, now int64) string {
+	if livestreamModel.Status != livestreamStatusScheduled {
+		return livestreamModel.Status
+	}
+	switch {
+	case livestreamModel.EndAt <= now:
+		return livestreamStatusEnded
+	case livestreamModel.StartAt <= now:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusScheduled
+	}
+}
+
+// checkLivestreamOpen は配信が配信中であることを確認する
+// 開始前の配信は配信者が開始すれば受け付ける
+func checkLivestreamOpen(livestreamModel LivestreamModel, now int64) error {
+	if !enforceLivestreamSchedule {
+		// 配信者が終了・取り消した配信だけ拒否する
+		switch livestreamModel.Status {
+		case livestreamStatusEnded, livestreamStatusCancelled:
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("livestream is %s; this operation is not allowed", livestreamModel.Status))
+		}
+		return nil
+	}
+
+	switch status := livestreamEffectiveStatus(livestreamModel, now); status {
+	case livestreamStatusScheduled:
+		return echo.NewHTTPError(http.StatusConflict, "livestream has not started yet; this operation is not allowed")
+	case livestreamStatusEnded, livestreamStatusCancelled:
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("livestream is %s; this operation is not allowed", status))
+	}
+	return nil
+}
+
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -648,7 +934,7 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 
 	tags := make([]Tag, len(tagIDs))
 	if len(tagIDs) > 0 {
-		query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
+		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?)", tagIDs)
 		if err != nil {
 			return Livestream{}, err
 		}
@@ -668,6 +954,15 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		Status:       livestreamEffectiveStatus(livestreamModel, time.Now().Unix()),
+		SeriesID:     nullInt64Pointer(livestreamModel.SeriesID),
 	}
 	return livestream, nil
 }
+
+func nullInt64Pointer(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
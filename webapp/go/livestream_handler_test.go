@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCheckLivestreamOpen(t *testing.T) {
+	const (
+		startAt int64 = 1700874000
+		endAt         = startAt + 60*60
+	)
+	tests := []struct {
+		name     string
+		status   string
+		now      int64
+		enforce  bool
+		wantOpen bool
+	}{
+		{name: "before start", status: livestreamStatusScheduled, now: startAt - 1, enforce: true, wantOpen: false},
+		{name: "started early by the streamer", status: livestreamStatusLive, now: startAt - 1, enforce: true, wantOpen: true},
+		{name: "within schedule", status: livestreamStatusScheduled, now: startAt, enforce: true, wantOpen: true},
+		{name: "past end_at", status: livestreamStatusScheduled, now: endAt, enforce: true, wantOpen: false},
+		{name: "ended by the streamer", status: livestreamStatusEnded, now: startAt, enforce: true, wantOpen: false},
+		{name: "cancelled", status: livestreamStatusCancelled, now: startAt - 1, enforce: true, wantOpen: false},
+		// スケジュールで制限しない場合は配信者の操作だけで決まる
+		{name: "past end_at without enforcement", status: livestreamStatusScheduled, now: endAt, enforce: false, wantOpen: true},
+		{name: "before start without enforcement", status: livestreamStatusScheduled, now: startAt - 1, enforce: false, wantOpen: true},
+		{name: "ended without enforcement", status: livestreamStatusEnded, now: startAt, enforce: false, wantOpen: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(enforce bool) { enforceLivestreamSchedule = enforce }(enforceLivestreamSchedule)
+			enforceLivestreamSchedule = tt.enforce
+
+			err := checkLivestreamOpen(LivestreamModel{Status: tt.status, StartAt: startAt, EndAt: endAt}, tt.now)
+			if tt.wantOpen {
+				if err != nil {
+					t.Errorf("checkLivestreamOpen() error = %v, want nil", err)
+				}
+				return
+			}
+			var httpErr *echo.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Code != http.StatusConflict {
+				t.Errorf("checkLivestreamOpen() error = %v, want 409", err)
+			}
+		})
+	}
+}
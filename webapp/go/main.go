@@ -4,6 +4,7 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -11,6 +12,8 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -27,12 +30,34 @@ import (
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	adminUsernamesEnvKey           = "ISUCON13_ADMIN_USERNAMES"
+	reservationTermStartAtEnvKey   = "ISUCON13_RESERVATION_TERM_START_AT"
+	reservationTermEndAtEnvKey     = "ISUCON13_RESERVATION_TERM_END_AT"
+	reservationSlotCapacityEnvKey  = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+	ngWordNormalizationEnvKey      = "ISUCON13_NGWORD_NORMALIZATION"
+	livestreamScheduleEnvKey       = "ISUCON13_ENFORCE_LIVESTREAM_SCHEDULE"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 管理APIを利用できるユーザ名 (カンマ区切りで指定)
+	adminUsernames = map[string]struct{}{}
+	// 配信を予約できる期間と、予約枠あたりの同時配信数
+	reservationTermStartAt        = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	reservationTermEndAt          = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+	reservationSlotCapacity int64 = 5
+	// NGワードの照合前に行う正規化。指定がなければ全て行う
+	ngWordNormalizationConfig = ngWordNormalization{
+		NFKC:        true,
+		CaseFold:    true,
+		KanaFold:    true,
+		StripSpaces: true,
+	}
+	// 予約時間外の配信へのコメント・リアクション・入室を拒否するか
+	// ベンチマーカーは予約期間 (2023-2024年) の配信を開始操作なしで使うため、falseを指定して配信者の終了・取り消しだけで制限する
+	enforceLivestreamSchedule = true
 )
 
 func init() {
@@ -40,6 +65,50 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	// 予約可能期間はRFC3339形式で指定する (例: 2023-11-25T10:00:00+09:00)
+	if v, ok := os.LookupEnv(reservationTermStartAtEnvKey); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as RFC3339: %+v", reservationTermStartAtEnvKey, err)
+		}
+		reservationTermStartAt = t
+	}
+	if v, ok := os.LookupEnv(reservationTermEndAtEnvKey); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as RFC3339: %+v", reservationTermEndAtEnvKey, err)
+		}
+		reservationTermEndAt = t
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		capacity, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || capacity < 1 {
+			log.Fatalf("environment variable '%s' must be a positive integer", reservationSlotCapacityEnvKey)
+		}
+		reservationSlotCapacity = capacity
+	}
+	if v, ok := os.LookupEnv(adminUsernamesEnvKey); ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				adminUsernames[name] = struct{}{}
+			}
+		}
+	}
+	// nfkc, casefold, kana, stripをカンマ区切りで指定する (例: nfkc,casefold)
+	if v, ok := os.LookupEnv(ngWordNormalizationEnvKey); ok {
+		n, err := parseNGWordNormalization(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s': %+v", ngWordNormalizationEnvKey, err)
+		}
+		ngWordNormalizationConfig = n
+	}
+	if v, ok := os.LookupEnv(livestreamScheduleEnvKey); ok {
+		enforce, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as bool: %+v", livestreamScheduleEnvKey, err)
+		}
+		enforceLivestreamSchedule = enforce
+	}
 }
 
 type InitializeResponse struct {
@@ -126,6 +195,23 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reactions_count: "+err.Error())
 	}
 
+	// 配信・配信者の統計の集計値を作り直す
+	if err := rebuildStats(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild stats: "+err.Error())
+	}
+
+	// NGワードは初期データで置き換わる
+	ngWordMatchers.reset()
+
+	// トレンドの集計を読み直す
+	if err := loadTrendingIndex(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load trending: "+err.Error())
+	}
+	// ランキングを作り直す
+	if err := loadRankingIndexes(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load ranking: "+err.Error())
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -133,6 +219,14 @@ func initializeHandler(c echo.Context) error {
 }
 
 func main() {
+	// サブコマンドが指定された場合はメンテナンス処理のみ行う
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("%s: %+v", os.Args[1], err)
+		}
+		return
+	}
+
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.ERROR)
@@ -147,15 +241,41 @@ func main() {
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/trending", getTrendingHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	e.PUT("/api/user/me/theme", putMyThemeHandler)
+
+	// tag (admin)
+	e.POST("/api/admin/tag", postTagHandler)
+	e.PUT("/api/admin/tag/:tag_id", putTagHandler)
+	e.DELETE("/api/admin/tag/:tag_id", retireTagHandler)
+	e.POST("/api/admin/tag/:tag_id/merge", mergeTagHandler)
+	e.POST("/api/admin/tag/:tag_id/alias", postTagAliasHandler)
+	e.DELETE("/api/admin/tag/:tag_id/alias/:alias", deleteTagAliasHandler)
+
+	// 集計値の監査 (admin)
+	e.GET("/api/admin/stats/audit", getStatsAuditHandler)
+
+	// reservation slot (admin)
+	e.POST("/api/admin/reservation_slots", postReservationSlotsHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 予約枠が埋まっている場合のキャンセル待ち
+	e.POST("/api/livestream/reservation/waitlist", joinReservationWaitlistHandler)
+	e.GET("/api/livestream/reservation/waitlist", getReservationWaitlistHandler)
+	e.DELETE("/api/livestream/reservation/waitlist/:waitlist_id", withdrawReservationWaitlistHandler)
+	// 繰り返し予約の今後の回をまとめて変更・取り消し
+	e.PUT("/api/livestream/series/:series_id", updateLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/series/:series_id", cancelLivestreamSeriesHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/recommended", getRecommendedLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	// カレンダーアプリから購読するため、セッションなしで取得できる
+	e.GET("/api/user/:username/livestream.ics", getUserLivestreamsCalendarHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
 	// get polling livecomment timeline
@@ -168,30 +288,65 @@ func main() {
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
+	e.GET("/api/livestream/:livestream_id/export", exportLivestreamHandler)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	// 非表示にしたライブコメントの復元とモデレーション履歴
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/restore", restoreLivecommentHandler)
+	e.GET("/api/livestream/:livestream_id/moderation_log", getModerationLogsHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴継続と同時視聴者数
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler)
+
+	// 配信の状態遷移 (streamer)
+	e.POST("/api/livestream/:livestream_id/start", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/cancel", cancelLivestreamHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/me/analytics", getMyAnalyticsHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	// follow
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
+	e.GET("/api/feed", getFeedHandler)
+
+	// notification
+	e.GET("/api/notifications", getNotificationsHandler)
+	e.GET("/api/notifications/unread_count", getUnreadNotificationCountHandler)
+	e.POST("/api/notifications/read", readAllNotificationsHandler)
+	e.POST("/api/notifications/:notification_id/read", readNotificationHandler)
+
+	// webhook
+	e.POST("/api/webhook", postWebhookHandler)
+	e.GET("/api/webhook", getWebhooksHandler)
+	e.DELETE("/api/webhook/:webhook_id", deleteWebhookHandler)
+	e.GET("/api/webhook/:webhook_id/delivery", getWebhookDeliveriesHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/statistics/timeseries", getLivestreamTimeseriesHandler)
+	e.GET("/api/livestream/:livestream_id/statistics/retention", getLivestreamRetentionHandler)
+
+	// ランキング
+	e.GET("/api/ranking/users", getUserRankingHandler)
+	e.GET("/api/ranking/livestreams", getLivestreamRankingHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
@@ -214,6 +369,18 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	if err := loadTrendingIndex(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load trending: %v", err)
+		os.Exit(1)
+	}
+	if err := loadRankingIndexes(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load ranking: %v", err)
+		os.Exit(1)
+	}
+
+	// Webhookの配送
+	go runWebhookDeliveryWorker(context.Background())
+
 	// go func() {
 	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
 	// }()
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブコメントのモデレーション操作
+const (
+	moderationActionHide    = "hide"
+	moderationActionRestore = "restore"
+)
+
+// 非表示にした理由
+const moderationReasonNGWord = "ng_word"
+
+// livecomment_moderation_logs.reasonの文字数の上限
+const maxModerationReasonLength = 255
+
+type LivecommentModerationLogModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	UserID        int64  `db:"user_id"`
+	Action        string `db:"action"`
+	Reason        string `db:"reason"`
+	// NGワードによる非表示の場合のみ
+	NGWordID  sql.NullInt64 `db:"ng_word_id"`
+	CreatedAt int64         `db:"created_at"`
+}
+
+type LivecommentModerationLog struct {
+	ID            int64  `json:"id"`
+	LivecommentID int64  `json:"livecomment_id"`
+	User          User   `json:"user"`
+	Action        string `json:"action"`
+	Reason        string `json:"reason"`
+	NGWordID      *int64 `json:"ng_word_id,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type RestoreLivecommentRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 非表示にしたライブコメントの復元API
+// POST /api/livestream/:livestream_id/livecomment/:livecomment_id/restore
+func restoreLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.ParseInt(c.Param("livecomment_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// 理由は任意
+	var req RestoreLivecommentRequest
+	if c.Request().ContentLength > 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		}
+	}
+	if utf8.RuneCountInString(req.Reason) > maxModerationReasonLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reason must be at most %d characters", maxModerationReasonLength))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't restore livecomments of other streamer's livestream")
+	}
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? FOR UPDATE", livecommentID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	if !livecommentModel.HiddenAt.Valid {
+		return echo.NewHTTPError(http.StatusConflict, "livecomment is not hidden")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET hidden_at = NULL, hidden_by = NULL, hidden_reason = '' WHERE id = ?", livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore livecomment: "+err.Error())
+	}
+	if err := insertModerationLog(ctx, tx, &LivecommentModerationLogModel{
+		LivecommentID: livecommentID,
+		LivestreamID:  livestreamID,
+		UserID:        userID,
+		Action:        moderationActionRestore,
+		Reason:        req.Reason,
+		CreatedAt:     time.Now().Unix(),
+	}); err != nil {
+		return err
+	}
+
+	// 非表示にした時に引いた分を戻す
+	restored := StatsCounters{Livecomments: 1, Tip: livecommentModel.Tip}
+	if err := adjustLivecommentCounters(ctx, tx, livestreamID, livestreamModel.UserID, restored); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update counters: "+err.Error())
+	}
+
+	livecommentModel.HiddenAt = sql.NullInt64{}
+	livecommentModel.HiddenBy = sql.NullInt64{}
+	livecommentModel.HiddenReason = ""
+	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if restored.Tip != 0 {
+		livestreamRankingIndex.add(livestreamID, restored.Tip)
+		userRankingIndex.add(livestreamModel.UserID, restored.Tip)
+	}
+	trending.record(time.Unix(livecommentModel.CreatedAt, 0), livestreamID, tagIDsOf(livecomment.Livestream.Tags), livecommentTrendingPoints(livecommentModel.Tip))
+
+	return c.JSON(http.StatusOK, livecomment)
+}
+
+// (配信者向け)モデレーション履歴API
+// GET /api/livestream/:livestream_id/moderation_log
+func getModerationLogsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get moderation logs of other streamer's livestream")
+	}
+
+	var logModels []*LivecommentModerationLogModel
+	if err := tx.SelectContext(ctx, &logModels, "SELECT * FROM livecomment_moderation_logs WHERE livestream_id = ? ORDER BY id DESC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation logs: "+err.Error())
+	}
+
+	// 操作するのは配信者なので、同じユーザは一度だけ取得する
+	users := make(map[int64]User)
+	logs := make([]LivecommentModerationLog, len(logModels))
+	for i, logModel := range logModels {
+		user, ok := users[logModel.UserID]
+		if !ok {
+			userModel := UserModel{}
+			if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", logModel.UserID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			}
+			user, err = fillUserResponse(ctx, tx, userModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+			}
+			users[logModel.UserID] = user
+		}
+		logs[i] = LivecommentModerationLog{
+			ID:            logModel.ID,
+			LivecommentID: logModel.LivecommentID,
+			User:          user,
+			Action:        logModel.Action,
+			Reason:        logModel.Reason,
+			NGWordID:      nullInt64Pointer(logModel.NGWordID),
+			CreatedAt:     logModel.CreatedAt,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
+
+// 一度に更新・INSERTする行数
+const moderationBatchSize = 1000
+
+const insertModerationLogQuery = "INSERT INTO livecomment_moderation_logs (livecomment_id, livestream_id, user_id, action, reason, ng_word_id, created_at) VALUES (:livecomment_id, :livestream_id, :user_id, :action, :reason, :ng_word_id, :created_at)"
+
+func insertModerationLog(ctx context.Context, tx *sqlx.Tx, logModel *LivecommentModerationLogModel) error {
+	if _, err := tx.NamedExecContext(ctx, insertModerationLogQuery, logModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation log: "+err.Error())
+	}
+	return nil
+}
+
+func insertModerationLogs(ctx context.Context, tx *sqlx.Tx, logModels []*LivecommentModerationLogModel) error {
+	for i := 0; i < len(logModels); i += moderationBatchSize {
+		batch := logModels[i:min(i+moderationBatchSize, len(logModels))]
+		if _, err := tx.NamedExecContext(ctx, insertModerationLogQuery, batch); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert moderation logs: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// hideLivecomments はライブコメントを非表示にする。集計値は呼び出し元で更新する
+func hideLivecomments(ctx context.Context, tx *sqlx.Tx, livecommentIDs []int64, userID int64, reason string, now int64) error {
+	for i := 0; i < len(livecommentIDs); i += moderationBatchSize {
+		batch := livecommentIDs[i:min(i+moderationBatchSize, len(livecommentIDs))]
+		query, args, err := sqlx.In("UPDATE livecomments SET hidden_at = ?, hidden_by = ?, hidden_reason = ? WHERE id IN (?)", now, userID, reason, batch)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for livecomments: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide livecomments: "+err.Error())
+		}
+	}
+	return nil
+}
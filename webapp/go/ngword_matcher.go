@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ngWordMatcher は配信のNGワードから作ったAho-Corasickオートマトン
+// NGワードとライブコメントを同じ正規化にかけた後、UTF-8のバイト列のまま照合する
+type ngWordMatcher struct {
+	normalization ngWordNormalization
+	next          []map[byte]int32
+	fail          []int32
+	// ノードまでの文字列の接尾辞に一致するNGワードのwordIDsでの位置。なければ-1
+	output  []int32
+	wordIDs []int64
+}
+
+func newNGWordMatcher(words []*NGWord, normalization ngWordNormalization) *ngWordMatcher {
+	m := &ngWordMatcher{
+		normalization: normalization,
+		next:          []map[byte]int32{{}},
+		output:        []int32{-1},
+		wordIDs:       make([]int64, len(words)),
+	}
+
+	// トライを作る
+	for i, word := range words {
+		m.wordIDs[i] = word.ID
+		w := normalization.normalize(word.Word)
+		if w == "" && word.Word != "" {
+			// 空白のみのNGワードが全てのライブコメントに一致しないようにする
+			continue
+		}
+		node := int32(0)
+		for j := 0; j < len(w); j++ {
+			child, ok := m.next[node][w[j]]
+			if !ok {
+				child = int32(len(m.next))
+				m.next = append(m.next, map[byte]int32{})
+				m.output = append(m.output, -1)
+				m.next[node][w[j]] = child
+			}
+			node = child
+		}
+		if m.output[node] < 0 {
+			m.output[node] = int32(i)
+		}
+	}
+
+	// 幅優先で失敗遷移を求め、一致するNGワードを失敗遷移先から引き継ぐ
+	m.fail = make([]int32, len(m.next))
+	queue := make([]int32, 0, len(m.next))
+	for _, child := range m.next[0] {
+		queue = append(queue, child)
+		if m.output[child] < 0 {
+			m.output[child] = m.output[0]
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for b, child := range m.next[node] {
+			f := m.fail[node]
+			for {
+				if to, ok := m.next[f][b]; ok {
+					m.fail[child] = to
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.fail[f]
+			}
+			if m.output[child] < 0 {
+				m.output[child] = m.output[m.fail[child]]
+			}
+			queue = append(queue, child)
+		}
+	}
+
+	return m
+}
+
+// find はtextに含まれるNGワードのIDを返す。複数含まれる場合は最も手前で終わるもの
+func (m *ngWordMatcher) find(text string) (int64, bool) {
+	if m.output[0] >= 0 {
+		return m.wordIDs[m.output[0]], true
+	}
+	text = m.normalization.normalize(text)
+	node := int32(0)
+	for i := 0; i < len(text); i++ {
+		for {
+			if to, ok := m.next[node][text[i]]; ok {
+				node = to
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = m.fail[node]
+		}
+		if m.output[node] >= 0 {
+			return m.wordIDs[m.output[node]], true
+		}
+	}
+	return 0, false
+}
+
+func loadNGWordMatcher(ctx context.Context, db *sqlx.DB, livestreamID int64) (*ngWordMatcher, error) {
+	var words []*NGWord
+	if err := db.SelectContext(ctx, &words, "SELECT * FROM ng_words WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return nil, fmt.Errorf("failed to get NG words: %w", err)
+	}
+	return newNGWordMatcher(words, ngWordNormalizationConfig), nil
+}
+
+// ngWordMatcherCache は配信ごとのオートマトンを保持する
+// NGワードを変更したトランザクションのコミット後にinvalidateを呼ぶ
+// 呼び出し元のトランザクションのスナップショットは古いことがあるので、NGワードは常に最新のものを読む
+type ngWordMatcherCache struct {
+	mu       sync.Mutex
+	matchers map[int64]*ngWordMatcher
+	// invalidateの前に読み込んだ古いオートマトンを保存しないための世代
+	generation uint64
+}
+
+var ngWordMatchers = &ngWordMatcherCache{matchers: make(map[int64]*ngWordMatcher)}
+
+func (c *ngWordMatcherCache) get(ctx context.Context, livestreamID int64) (*ngWordMatcher, error) {
+	c.mu.Lock()
+	m, ok := c.matchers[livestreamID]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	m, err := loadNGWordMatcher(ctx, dbConn, livestreamID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.matchers[livestreamID] = m
+	}
+	return m, nil
+}
+
+func (c *ngWordMatcherCache) invalidate(livestreamID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.matchers, livestreamID)
+	c.generation++
+}
+
+func (c *ngWordMatcherCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.matchers = make(map[int64]*ngWordMatcher)
+	c.generation++
+}
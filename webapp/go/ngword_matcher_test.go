@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestNGWordMatcherFind(t *testing.T) {
+	tests := []struct {
+		name   string
+		words  []string
+		text   string
+		wantID int64
+		wantOK bool
+	}{
+		{name: "no words", words: nil, text: "hello", wantOK: false},
+		{name: "no match", words: []string{"bad"}, text: "good comment", wantOK: false},
+		{name: "exact", words: []string{"bad"}, text: "bad", wantID: 1, wantOK: true},
+		{name: "substring", words: []string{"bad"}, text: "this is bad!", wantID: 1, wantOK: true},
+		// 最も手前で終わるNGワードを返す
+		{name: "earliest end wins", words: []string{"hers", "his"}, text: "ahishers", wantID: 2, wantOK: true},
+		// 同じ位置で終わる場合は長い方
+		{name: "suffix word at same end", words: []string{"he", "she"}, text: "ushe", wantID: 2, wantOK: true},
+		{name: "suffix word found through failure link", words: []string{"she", "he"}, text: "ahe", wantID: 2, wantOK: true},
+		{name: "overlapping words", words: []string{"abcd", "bcx"}, text: "abcx", wantID: 2, wantOK: true},
+		{name: "prefix of a word only", words: []string{"abcd"}, text: "abc", wantOK: false},
+		{name: "repeated prefix", words: []string{"aab"}, text: "aaab", wantID: 1, wantOK: true},
+		{name: "multibyte", words: []string{"バカ"}, text: "お前はバカだ", wantID: 1, wantOK: true},
+		// 先頭のバイトが同じでも別の文字には一致しない
+		{name: "multibyte sharing leading bytes", words: []string{"あい"}, text: "あうい", wantOK: false},
+		{name: "multibyte and ascii", words: []string{"ng", "ダメ"}, text: "ダメng", wantID: 2, wantOK: true},
+		{name: "empty word matches everything", words: []string{""}, text: "anything", wantID: 1, wantOK: true},
+		{name: "whitespace-only word is literal without normalization", words: []string{"  "}, text: "a  b", wantID: 1, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			words := make([]*NGWord, len(tt.words))
+			for i, word := range tt.words {
+				words[i] = &NGWord{ID: int64(i + 1), Word: word}
+			}
+			m := newNGWordMatcher(words, ngWordNormalization{})
+			gotID, gotOK := m.find(tt.text)
+			if gotOK != tt.wantOK || (gotOK && gotID != tt.wantID) {
+				t.Errorf("find(%q) = (%d, %v), want (%d, %v)", tt.text, gotID, gotOK, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNGWordMatcherWhitespaceOnlyWord(t *testing.T) {
+	words := []*NGWord{{ID: 1, Word: " \u3000\u200b"}, {ID: 2, Word: "bad"}}
+	m := newNGWordMatcher(words, ngWordNormalization{StripSpaces: true})
+
+	// 空白を除くと空になるNGワードは全てのコメントに一致しない
+	if id, ok := m.find("good comment"); ok {
+		t.Errorf("find() matched word %d", id)
+	}
+	if id, ok := m.find("b a d"); !ok || id != 2 {
+		t.Errorf("find() = (%d, %v), want (2, true)", id, ok)
+	}
+}
+
+// strings.Containsで全てのNGワードを調べた結果と一致する
+func TestNGWordMatcherMatchesContains(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "c", "あ", "い"}
+	randomString := func(maxLen int) string {
+		var b strings.Builder
+		n := rng.Intn(maxLen) + 1
+		for i := 0; i < n; i++ {
+			b.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		return b.String()
+	}
+
+	for i := 0; i < 500; i++ {
+		words := make([]*NGWord, rng.Intn(6)+1)
+		for j := range words {
+			words[j] = &NGWord{ID: int64(j + 1), Word: randomString(4)}
+		}
+		m := newNGWordMatcher(words, ngWordNormalization{})
+
+		text := randomString(12)
+		want := false
+		for _, word := range words {
+			if strings.Contains(text, word.Word) {
+				want = true
+			}
+		}
+		id, got := m.find(text)
+		if got != want {
+			t.Fatalf("find(%q) = %v, want %v", text, got, want)
+		}
+		if got && !strings.Contains(text, words[id-1].Word) {
+			t.Fatalf("find(%q) returned word %q which is not contained", text, words[id-1].Word)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ngWordNormalization はNGワードとライブコメントを照合する前に行う正規化
+// noneを指定すると正規化せず、バイト列のまま照合する
+type ngWordNormalization struct {
+	// 全角英数字・半角カナなどの互換文字をまとめる
+	NFKC bool
+	// 大文字と小文字を区別しない
+	CaseFold bool
+	// ひらがなをカタカナに揃える
+	KanaFold bool
+	// 空白とゼロ幅文字を取り除く
+	StripSpaces bool
+}
+
+func parseNGWordNormalization(v string) (ngWordNormalization, error) {
+	var n ngWordNormalization
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "nfkc":
+			n.NFKC = true
+		case "casefold":
+			n.CaseFold = true
+		case "kana":
+			n.KanaFold = true
+		case "strip":
+			n.StripSpaces = true
+		case "none", "":
+		default:
+			return ngWordNormalization{}, fmt.Errorf("unknown normalization: %s", name)
+		}
+	}
+	return n, nil
+}
+
+func (n ngWordNormalization) normalize(s string) string {
+	if n.NFKC {
+		s = norm.NFKC.String(s)
+	}
+	if n.CaseFold {
+		// Caserはgoroutine間で共有できないので都度作る
+		s = cases.Fold().String(s)
+	}
+	if n.KanaFold || n.StripSpaces {
+		s = strings.Map(func(r rune) rune {
+			if n.StripSpaces && (unicode.IsSpace(r) || unicode.Is(unicode.Cf, r)) {
+				return -1
+			}
+			// ぁ(U+3041)からゖ(U+3096)は、0x60を足すと対応するカタカナになる
+			if n.KanaFold && r >= 'ぁ' && r <= 'ゖ' {
+				return r + 0x60
+			}
+			return r
+		}, s)
+	}
+	return s
+}
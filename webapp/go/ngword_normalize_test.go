@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNGWordNormalizationNormalize(t *testing.T) {
+	all := ngWordNormalization{NFKC: true, CaseFold: true, KanaFold: true, StripSpaces: true}
+	tests := []struct {
+		name          string
+		normalization ngWordNormalization
+		in            string
+		want          string
+	}{
+		{name: "none", normalization: ngWordNormalization{}, in: "ＢＡＤ ばか", want: "ＢＡＤ ばか"},
+		{name: "full-width alphabet", normalization: ngWordNormalization{NFKC: true}, in: "ＢＡＤ", want: "BAD"},
+		{name: "full-width digits", normalization: ngWordNormalization{NFKC: true}, in: "１２３", want: "123"},
+		{name: "half-width katakana", normalization: ngWordNormalization{NFKC: true}, in: "ﾊﾞｶ", want: "バカ"},
+		{name: "case fold", normalization: ngWordNormalization{CaseFold: true}, in: "BaD", want: "bad"},
+		{name: "case fold sharp s", normalization: ngWordNormalization{CaseFold: true}, in: "Straße", want: "strasse"},
+		{name: "case fold without nfkc keeps full-width", normalization: ngWordNormalization{CaseFold: true}, in: "ＢＡＤ", want: "ｂａｄ"},
+		{name: "hiragana to katakana", normalization: ngWordNormalization{KanaFold: true}, in: "ばかぁゖ", want: "バカァヶ"},
+		{name: "kana fold keeps katakana and kanji", normalization: ngWordNormalization{KanaFold: true}, in: "バカ阿呆ー", want: "バカ阿呆ー"},
+		{name: "strip spaces", normalization: ngWordNormalization{StripSpaces: true}, in: "b a\td\n", want: "bad"},
+		{name: "strip ideographic space", normalization: ngWordNormalization{StripSpaces: true}, in: "ば\u3000か", want: "ばか"},
+		{name: "strip zero-width characters", normalization: ngWordNormalization{StripSpaces: true}, in: "b\u200ba\u200cd\u200d\u2060\ufeff", want: "bad"},
+		{name: "all", normalization: all, in: "Ｂ ａ\u200bＤ", want: "bad"},
+		{name: "all with kana", normalization: all, in: "ﾊﾞ か", want: "バカ"},
+		{name: "all with hiragana", normalization: all, in: "ばか", want: "バカ"},
+		{name: "all keeps other text", normalization: all, in: "good", want: "good"},
+		{name: "all whitespace only", normalization: all, in: " \u3000\u200b", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.normalization.normalize(tt.in); got != tt.want {
+				t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNGWordNormalization(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ngWordNormalization
+		wantErr bool
+	}{
+		{in: "none", want: ngWordNormalization{}},
+		{in: "", want: ngWordNormalization{}},
+		{in: "nfkc", want: ngWordNormalization{NFKC: true}},
+		{in: "nfkc, casefold", want: ngWordNormalization{NFKC: true, CaseFold: true}},
+		{in: "nfkc,casefold,kana,strip", want: ngWordNormalization{NFKC: true, CaseFold: true, KanaFold: true, StripSpaces: true}},
+		{in: "nfc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseNGWordNormalization(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseNGWordNormalization(%q) error = nil, want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNGWordNormalization(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseNGWordNormalization(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNGWordMatcherNormalizes(t *testing.T) {
+	all := ngWordNormalization{NFKC: true, CaseFold: true, KanaFold: true, StripSpaces: true}
+	words := []*NGWord{{ID: 1, Word: "bad"}, {ID: 2, Word: "ばか"}, {ID: 3, Word: "ＮＧ"}}
+	m := newNGWordMatcher(words, all)
+
+	tests := []struct {
+		text   string
+		wantID int64
+		wantOK bool
+	}{
+		{text: "ＢＡＤ", wantID: 1, wantOK: true},
+		{text: "Bad", wantID: 1, wantOK: true},
+		{text: "b\u200ba d", wantID: 1, wantOK: true},
+		{text: "バカ", wantID: 2, wantOK: true},
+		{text: "ﾊﾞｶ", wantID: 2, wantOK: true},
+		{text: "ば か", wantID: 2, wantOK: true},
+		{text: "ng", wantID: 3, wantOK: true},
+		{text: "good", wantOK: false},
+	}
+	for _, tt := range tests {
+		gotID, gotOK := m.find(tt.text)
+		if gotOK != tt.wantOK || (gotOK && gotID != tt.wantID) {
+			t.Errorf("find(%q) = (%d, %v), want (%d, %v)", tt.text, gotID, gotOK, tt.wantID, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 通知の種類
+const (
+	// フォロー中の配信者が配信を予約した
+	notificationTypeLivestreamReserved = "livestream_reserved"
+	// フォロー中の配信者が配信を開始した
+	notificationTypeLivestreamStarted = "livestream_started"
+	// 自分の配信にチップ付きのコメントが投稿された
+	notificationTypeTipReceived = "tip_received"
+	// 自分のコメントが報告された
+	notificationTypeLivecommentReported = "livecomment_reported"
+	// キャンセル待ちしていた配信が予約された
+	notificationTypeWaitlistBooked = "waitlist_booked"
+)
+
+const defaultNotificationsLimit = 50
+
+type NotificationModel struct {
+	ID            int64         `db:"id"`
+	UserID        int64         `db:"user_id"`
+	Type          string        `db:"type"`
+	ActorID       sql.NullInt64 `db:"actor_id"`
+	LivestreamID  sql.NullInt64 `db:"livestream_id"`
+	LivecommentID sql.NullInt64 `db:"livecomment_id"`
+	Tip           int64         `db:"tip"`
+	ReadAt        sql.NullInt64 `db:"read_at"`
+	CreatedAt     int64         `db:"created_at"`
+}
+
+type Notification struct {
+	ID            int64  `json:"id"`
+	Type          string `json:"type"`
+	ActorID       *int64 `json:"actor_id,omitempty"`
+	LivestreamID  *int64 `json:"livestream_id,omitempty"`
+	LivecommentID *int64 `json:"livecomment_id,omitempty"`
+	Tip           int64  `json:"tip,omitempty"`
+	Read          bool   `json:"read"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int64          `json:"unread_count"`
+}
+
+type UnreadNotificationCountResponse struct {
+	UnreadCount int64 `json:"unread_count"`
+}
+
+// 通知一覧API
+// unread=trueで未読のみを返す
+// GET /api/notifications
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultNotificationsLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+	}
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	if c.QueryParam("before") != "" {
+		before, err := strconv.ParseInt(c.QueryParam("before"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var notificationModels []*NotificationModel
+	if err := tx.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	unreadCount, err := countUnreadNotifications(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unread notifications: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i := range notificationModels {
+		notifications[i] = fillNotificationResponse(*notificationModels[i])
+	}
+
+	return c.JSON(http.StatusOK, &NotificationsResponse{
+		Notifications: notifications,
+		UnreadCount:   unreadCount,
+	})
+}
+
+// 未読通知数API
+// GET /api/notifications/unread_count
+func getUnreadNotificationCountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	unreadCount, err := countUnreadNotifications(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unread notifications: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UnreadNotificationCountResponse{
+		UnreadCount: unreadCount,
+	})
+}
+
+// 通知既読API
+// POST /api/notifications/:notification_id/read
+func readNotificationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	notificationID, err := strconv.ParseInt(c.Param("notification_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "notification_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var notificationModel NotificationModel
+	if err := tx.GetContext(ctx, &notificationModel, "SELECT * FROM notifications WHERE id = ? AND user_id = ? FOR UPDATE", notificationID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found notification that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notification: "+err.Error())
+	}
+
+	// 既読のものは既読日時を更新しない
+	if !notificationModel.ReadAt.Valid {
+		now := time.Now().Unix()
+		if _, err := tx.ExecContext(ctx, "UPDATE notifications SET read_at = ? WHERE id = ?", now, notificationID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notification: "+err.Error())
+		}
+		notificationModel.ReadAt = sql.NullInt64{Int64: now, Valid: true}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillNotificationResponse(notificationModel))
+}
+
+// 全通知既読API
+// POST /api/notifications/read
+func readAllNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", time.Now().Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UnreadNotificationCountResponse{
+		UnreadCount: 0,
+	})
+}
+
+func countUnreadNotifications(ctx context.Context, tx *sqlx.Tx, userID int64) (int64, error) {
+	var unreadCount int64
+	if err := tx.GetContext(ctx, &unreadCount, "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID); err != nil {
+		return 0, err
+	}
+	return unreadCount, nil
+}
+
+// insertNotification はユーザーへの通知を1件登録する
+func insertNotification(ctx context.Context, tx *sqlx.Tx, notificationModel *NotificationModel) error {
+	notificationModel.CreatedAt = time.Now().Unix()
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO notifications (user_id, type, actor_id, livestream_id, livecomment_id, tip, created_at) VALUES (:user_id, :type, :actor_id, :livestream_id, :livecomment_id, :tip, :created_at)", notificationModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert notification: "+err.Error())
+	}
+	return nil
+}
+
+// notifyFollowers は配信者のフォロワー全員に配信についての通知を登録する
+func notifyFollowers(ctx context.Context, tx *sqlx.Tx, notificationType string, livestreamModel LivestreamModel) error {
+	query := `
+	INSERT INTO notifications (user_id, type, actor_id, livestream_id, tip, created_at)
+	SELECT follower_id, ?, ?, ?, 0, ? FROM follows WHERE followee_id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, notificationType, livestreamModel.UserID, livestreamModel.ID, time.Now().Unix(), livestreamModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert notifications: "+err.Error())
+	}
+	return nil
+}
+
+func fillNotificationResponse(notificationModel NotificationModel) Notification {
+	return Notification{
+		ID:            notificationModel.ID,
+		Type:          notificationModel.Type,
+		ActorID:       nullInt64Pointer(notificationModel.ActorID),
+		LivestreamID:  nullInt64Pointer(notificationModel.LivestreamID),
+		LivecommentID: nullInt64Pointer(notificationModel.LivecommentID),
+		Tip:           notificationModel.Tip,
+		Read:          notificationModel.ReadAt.Valid,
+		CreatedAt:     notificationModel.CreatedAt,
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ランキングの集計期間
+const (
+	rankingPeriodDaily   = "daily"
+	rankingPeriodWeekly  = "weekly"
+	rankingPeriodAllTime = "all"
+)
+
+// 日間・週間は直近24時間・7日間のリアクション数とチップ合計で集計する
+var rankingPeriodDurations = map[string]time.Duration{
+	rankingPeriodDaily:  24 * time.Hour,
+	rankingPeriodWeekly: 7 * 24 * time.Hour,
+}
+
+const (
+	defaultRankingLimit = 20
+	maxRankingLimit     = 100
+)
+
+type UserRankingItem struct {
+	Rank  int64 `json:"rank"`
+	Score int64 `json:"score"`
+	User  User  `json:"user"`
+}
+
+type LivestreamRankingItem struct {
+	Rank       int64      `json:"rank"`
+	Score      int64      `json:"score"`
+	Livestream Livestream `json:"livestream"`
+}
+
+type UserRankingResponse struct {
+	Period  string            `json:"period"`
+	Total   int64             `json:"total"`
+	Limit   int               `json:"limit"`
+	Offset  int               `json:"offset"`
+	Ranking []UserRankingItem `json:"ranking"`
+}
+
+type LivestreamRankingResponse struct {
+	Period  string                  `json:"period"`
+	Total   int64                   `json:"total"`
+	Limit   int                     `json:"limit"`
+	Offset  int                     `json:"offset"`
+	Ranking []LivestreamRankingItem `json:"ranking"`
+}
+
+type rankingQuery struct {
+	Period string
+	Since  int64
+	Limit  int
+	Offset int
+}
+
+type userRankingRow struct {
+	UserModel
+	Score int64 `db:"score"`
+}
+
+type livestreamRankingRow struct {
+	LivestreamModel
+	Score int64 `db:"score"`
+}
+
+// 配信者ランキングAPI
+// 同点の場合はUserRankingと同じくユーザ名の降順
+// GET /api/ranking/users
+func getUserRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	q, err := parseRankingQuery(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var total int64
+	if err := tx.GetContext(ctx, &total, "SELECT COUNT(*) FROM users"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count users: "+err.Error())
+	}
+
+	rows, err := getUserRankingRows(ctx, tx, q)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+	}
+
+	ranking := make([]UserRankingItem, len(rows))
+	for i, row := range rows {
+		user, err := fillUserResponse(ctx, tx, row.UserModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		ranking[i] = UserRankingItem{
+			Rank:  int64(q.Offset + i + 1),
+			Score: row.Score,
+			User:  user,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UserRankingResponse{
+		Period:  q.Period,
+		Total:   total,
+		Limit:   q.Limit,
+		Offset:  q.Offset,
+		Ranking: ranking,
+	})
+}
+
+// 配信ランキングAPI
+// 同点の場合はLivestreamRankingと同じく配信IDの降順
+// GET /api/ranking/livestreams
+func getLivestreamRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	q, err := parseRankingQuery(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var total int64
+	if err := tx.GetContext(ctx, &total, "SELECT COUNT(*) FROM livestreams"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+	}
+
+	rows, err := getLivestreamRankingRows(ctx, tx, q)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
+	}
+
+	livestreamModels := make([]*LivestreamModel, len(rows))
+	for i := range rows {
+		livestreamModels[i] = &rows[i].LivestreamModel
+	}
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	ranking := make([]LivestreamRankingItem, len(rows))
+	for i, row := range rows {
+		ranking[i] = LivestreamRankingItem{
+			Rank:       int64(q.Offset + i + 1),
+			Score:      row.Score,
+			Livestream: livestreams[i],
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &LivestreamRankingResponse{
+		Period:  q.Period,
+		Total:   total,
+		Limit:   q.Limit,
+		Offset:  q.Offset,
+		Ranking: ranking,
+	})
+}
+
+func parseRankingQuery(c echo.Context) (*rankingQuery, error) {
+	q := &rankingQuery{
+		Period: rankingPeriodAllTime,
+		Limit:  defaultRankingLimit,
+	}
+
+	if c.QueryParam("period") != "" {
+		q.Period = c.QueryParam("period")
+	}
+	if duration, ok := rankingPeriodDurations[q.Period]; ok {
+		q.Since = time.Now().Add(-duration).Unix()
+	} else if q.Period != rankingPeriodAllTime {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "period query parameter must be one of daily, weekly, all")
+	}
+
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxRankingLimit {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer between 1 and 100")
+		}
+		q.Limit = limit
+	}
+	if c.QueryParam("offset") != "" {
+		offset, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || offset < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+		q.Offset = offset
+	}
+
+	return q, nil
+}
+
+func getUserRankingRows(ctx context.Context, tx *sqlx.Tx, q *rankingQuery) ([]*userRankingRow, error) {
+	var rows []*userRankingRow
+	if q.Period == rankingPeriodAllTime {
+		query := "SELECT u.*, u.reactions_count + u.tip AS score FROM users u ORDER BY score DESC, u.name DESC LIMIT ? OFFSET ?"
+		if err := tx.SelectContext(ctx, &rows, query, q.Limit, q.Offset); err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	query := `
+	SELECT u.*, IFNULL(r.reactions, 0) + IFNULL(t.tip, 0) AS score FROM users u
+	LEFT JOIN (
+		SELECT l.user_id, COUNT(*) AS reactions FROM reactions r
+		INNER JOIN livestreams l ON l.id = r.livestream_id
+		WHERE r.created_at >= ?
+		GROUP BY l.user_id
+	) r ON r.user_id = u.id
+	LEFT JOIN (
+		SELECT l.user_id, SUM(lc.tip) AS tip FROM livecomments lc
+		INNER JOIN livestreams l ON l.id = lc.livestream_id
+		WHERE lc.created_at >= ? AND lc.hidden_at IS NULL
+		GROUP BY l.user_id
+	) t ON t.user_id = u.id
+	ORDER BY score DESC, u.name DESC
+	LIMIT ? OFFSET ?
+	`
+	if err := tx.SelectContext(ctx, &rows, query, q.Since, q.Since, q.Limit, q.Offset); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func getLivestreamRankingRows(ctx context.Context, tx *sqlx.Tx, q *rankingQuery) ([]*livestreamRankingRow, error) {
+	var rows []*livestreamRankingRow
+	if q.Period == rankingPeriodAllTime {
+		query := "SELECT l.*, l.reactions_count + l.tip AS score FROM livestreams l ORDER BY score DESC, l.id DESC LIMIT ? OFFSET ?"
+		if err := tx.SelectContext(ctx, &rows, query, q.Limit, q.Offset); err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	query := `
+	SELECT l.*, IFNULL(r.reactions, 0) + IFNULL(t.tip, 0) AS score FROM livestreams l
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS reactions FROM reactions
+		WHERE created_at >= ?
+		GROUP BY livestream_id
+	) r ON r.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, SUM(tip) AS tip FROM livecomments
+		WHERE created_at >= ? AND hidden_at IS NULL
+		GROUP BY livestream_id
+	) t ON t.livestream_id = l.id
+	ORDER BY score DESC, l.id DESC
+	LIMIT ? OFFSET ?
+	`
+	if err := tx.SelectContext(ctx, &rows, query, q.Since, q.Since, q.Limit, q.Offset); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
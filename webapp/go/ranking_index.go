@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// rankingTree は部分木の大きさを持つtreapで、キーより上位の件数をO(log n)で求める
+type rankingTree[K any] struct {
+	root *rankingNode[K]
+	less func(a, b K) bool
+}
+
+type rankingNode[K any] struct {
+	key         K
+	priority    uint32
+	size        int
+	left, right *rankingNode[K]
+}
+
+func (n *rankingNode[K]) update() {
+	n.size = 1 + rankingNodeSize(n.left) + rankingNodeSize(n.right)
+}
+
+func rankingNodeSize[K any](n *rankingNode[K]) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// split はキーより小さいノードと、キー以上のノードに分ける
+func (t *rankingTree[K]) split(n *rankingNode[K], key K) (*rankingNode[K], *rankingNode[K]) {
+	if n == nil {
+		return nil, nil
+	}
+	if t.less(n.key, key) {
+		l, r := t.split(n.right, key)
+		n.right = l
+		n.update()
+		return n, r
+	}
+	l, r := t.split(n.left, key)
+	n.left = r
+	n.update()
+	return l, n
+}
+
+// splitAfter はキー以下のノードと、キーより大きいノードに分ける
+func (t *rankingTree[K]) splitAfter(n *rankingNode[K], key K) (*rankingNode[K], *rankingNode[K]) {
+	if n == nil {
+		return nil, nil
+	}
+	if !t.less(key, n.key) {
+		l, r := t.splitAfter(n.right, key)
+		n.right = l
+		n.update()
+		return n, r
+	}
+	l, r := t.splitAfter(n.left, key)
+	n.left = r
+	n.update()
+	return l, n
+}
+
+// merge はlの全てのキーがrより小さいものとして連結する
+func (t *rankingTree[K]) merge(l, r *rankingNode[K]) *rankingNode[K] {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l.right = t.merge(l.right, r)
+		l.update()
+		return l
+	}
+	r.left = t.merge(l, r.left)
+	r.update()
+	return r
+}
+
+func (t *rankingTree[K]) insert(key K) {
+	l, r := t.split(t.root, key)
+	n := &rankingNode[K]{key: key, priority: rand.Uint32(), size: 1}
+	t.root = t.merge(t.merge(l, n), r)
+}
+
+func (t *rankingTree[K]) remove(key K) {
+	l, r := t.split(t.root, key)
+	_, r = t.splitAfter(r, key)
+	t.root = t.merge(l, r)
+}
+
+// countGreater はキーより上位のノードの数を返す
+func (t *rankingTree[K]) countGreater(key K) int {
+	count := 0
+	n := t.root
+	for n != nil {
+		if t.less(key, n.key) {
+			count += 1 + rankingNodeSize(n.right)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return count
+}
+
+// rankingIndex はIDごとの現在のキーを持ち、スコアの更新に合わせて木を差し替える
+type rankingIndex[ID comparable, K any] struct {
+	mu   sync.Mutex
+	tree *rankingTree[K]
+	keys map[ID]K
+	less func(a, b K) bool
+	// キーのスコアにdeltaを加えたキーを返す
+	addScore func(key K, delta int64) K
+}
+
+func newRankingIndex[ID comparable, K any](less func(a, b K) bool, addScore func(key K, delta int64) K) *rankingIndex[ID, K] {
+	return &rankingIndex[ID, K]{
+		tree:     &rankingTree[K]{less: less},
+		keys:     make(map[ID]K),
+		less:     less,
+		addScore: addScore,
+	}
+}
+
+func (idx *rankingIndex[ID, K]) reset(keys map[ID]K) {
+	tree := &rankingTree[K]{less: idx.less}
+	for _, key := range keys {
+		tree.insert(key)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.tree = tree
+	idx.keys = keys
+}
+
+// set はIDのキーを登録する。既にあれば置き換える
+func (idx *rankingIndex[ID, K]) set(id ID, key K) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, ok := idx.keys[id]; ok {
+		idx.tree.remove(old)
+	}
+	idx.tree.insert(key)
+	idx.keys[id] = key
+}
+
+// add はIDのスコアにdeltaを加える。未登録のIDは何もしない
+func (idx *rankingIndex[ID, K]) add(id ID, delta int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	old, ok := idx.keys[id]
+	if !ok {
+		return
+	}
+	key := idx.addScore(old, delta)
+	idx.tree.remove(old)
+	idx.tree.insert(key)
+	idx.keys[id] = key
+}
+
+// rank はIDの順位 (1始まり) を返す。未登録ならfallbackで登録してから求める
+func (idx *rankingIndex[ID, K]) rank(id ID, fallback K) int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	key, ok := idx.keys[id]
+	if !ok {
+		key = fallback
+		idx.tree.insert(key)
+		idx.keys[id] = key
+	}
+	return int64(idx.tree.countGreater(key)) + 1
+}
+
+// 配信者と配信のランキング
+// 同点の場合の順序はUserRanking, LivestreamRankingのLessと同じ
+var (
+	userRankingIndex = newRankingIndex[int64](
+		func(a, b UserRankingEntry) bool { return UserRanking{a, b}.Less(0, 1) },
+		func(key UserRankingEntry, delta int64) UserRankingEntry {
+			key.Score += delta
+			return key
+		},
+	)
+	livestreamRankingIndex = newRankingIndex[int64](
+		func(a, b LivestreamRankingEntry) bool { return LivestreamRanking{a, b}.Less(0, 1) },
+		func(key LivestreamRankingEntry, delta int64) LivestreamRankingEntry {
+			key.Score += delta
+			return key
+		},
+	)
+)
+
+// addLivestreamsToRanking は新しく作成された配信をランキングに登録する
+// トランザクションのコミット後に呼ぶ
+func addLivestreamsToRanking(livestreamModels []*LivestreamModel) {
+	for _, livestreamModel := range livestreamModels {
+		livestreamRankingIndex.set(livestreamModel.ID, LivestreamRankingEntry{
+			LivestreamID: livestreamModel.ID,
+			Score:        livestreamModel.ReactionsCount + livestreamModel.Tip,
+		})
+	}
+}
+
+// loadRankingIndexes は配信者と配信のランキングをDBから作り直す
+func loadRankingIndexes(ctx context.Context) error {
+	type rankingRow struct {
+		ID    int64  `db:"id"`
+		Name  string `db:"name"`
+		Score int64  `db:"score"`
+	}
+
+	var users []*rankingRow
+	if err := dbConn.SelectContext(ctx, &users, "SELECT id, name, reactions_count + tip AS score FROM users"); err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+	userKeys := make(map[int64]UserRankingEntry, len(users))
+	for _, user := range users {
+		userKeys[user.ID] = UserRankingEntry{Username: user.Name, Score: user.Score}
+	}
+
+	var livestreams []*rankingRow
+	if err := dbConn.SelectContext(ctx, &livestreams, "SELECT id, '' AS name, reactions_count + tip AS score FROM livestreams"); err != nil {
+		return fmt.Errorf("failed to get livestreams: %w", err)
+	}
+	livestreamKeys := make(map[int64]LivestreamRankingEntry, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamKeys[livestream.ID] = LivestreamRankingEntry{LivestreamID: livestream.ID, Score: livestream.Score}
+	}
+
+	userRankingIndex.reset(userKeys)
+	livestreamRankingIndex.reset(livestreamKeys)
+	return nil
+}
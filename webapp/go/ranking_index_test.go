@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newTestLivestreamRankingIndex() *rankingIndex[int64, LivestreamRankingEntry] {
+	return newRankingIndex[int64](
+		func(a, b LivestreamRankingEntry) bool { return LivestreamRanking{a, b}.Less(0, 1) },
+		func(key LivestreamRankingEntry, delta int64) LivestreamRankingEntry {
+			key.Score += delta
+			return key
+		},
+	)
+}
+
+func TestRankingIndex(t *testing.T) {
+	type op struct {
+		// set, add
+		kind  string
+		id    int64
+		score int64
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		// IDごとの期待する順位
+		want map[int64]int64
+	}{
+		{
+			name: "ordered by score",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 30}, {"set", 3, 20}},
+			want: map[int64]int64{1: 3, 2: 1, 3: 2},
+		},
+		{
+			name: "ties are broken by larger id first",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 10}, {"set", 3, 10}},
+			want: map[int64]int64{1: 3, 2: 2, 3: 1},
+		},
+		{
+			name: "add moves up",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 20}, {"set", 3, 30}, {"add", 1, 25}},
+			want: map[int64]int64{1: 1, 2: 3, 3: 2},
+		},
+		{
+			name: "negative add moves down",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 20}, {"set", 3, 30}, {"add", 3, -25}},
+			want: map[int64]int64{1: 2, 2: 1, 3: 3},
+		},
+		{
+			name: "set replaces the previous key",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 20}, {"set", 1, 30}},
+			want: map[int64]int64{1: 1, 2: 2},
+		},
+		{
+			name: "add to unknown id is ignored",
+			ops:  []op{{"set", 1, 10}, {"add", 2, 100}},
+			want: map[int64]int64{1: 1},
+		},
+		{
+			name: "add to a tie",
+			ops:  []op{{"set", 1, 10}, {"set", 2, 20}, {"add", 1, 10}},
+			want: map[int64]int64{1: 2, 2: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := newTestLivestreamRankingIndex()
+			for _, o := range tt.ops {
+				switch o.kind {
+				case "set":
+					idx.set(o.id, LivestreamRankingEntry{LivestreamID: o.id, Score: o.score})
+				case "add":
+					idx.add(o.id, o.score)
+				}
+			}
+			for id, want := range tt.want {
+				if got := idx.rank(id, LivestreamRankingEntry{}); got != want {
+					t.Errorf("rank(%d) = %d, want %d", id, got, want)
+				}
+			}
+			if got := idx.tree.countGreater(LivestreamRankingEntry{LivestreamID: -1, Score: -1 << 62}); got != len(tt.want) {
+				t.Errorf("tree has %d nodes, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestRankingIndexRankFallback(t *testing.T) {
+	idx := newTestLivestreamRankingIndex()
+	idx.set(1, LivestreamRankingEntry{LivestreamID: 1, Score: 10})
+
+	// 未登録のIDはfallbackで登録される
+	if got := idx.rank(2, LivestreamRankingEntry{LivestreamID: 2, Score: 20}); got != 1 {
+		t.Errorf("rank(2) = %d, want 1", got)
+	}
+	if got := idx.rank(1, LivestreamRankingEntry{}); got != 2 {
+		t.Errorf("rank(1) = %d, want 2", got)
+	}
+	// 登録済みならfallbackは使わない
+	if got := idx.rank(2, LivestreamRankingEntry{LivestreamID: 2, Score: 0}); got != 1 {
+		t.Errorf("rank(2) = %d, want 1", got)
+	}
+}
+
+func TestRankingIndexRandomUpdates(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	idx := newTestLivestreamRankingIndex()
+	scores := make(map[int64]int64)
+
+	keys := make(map[int64]LivestreamRankingEntry)
+	for i := int64(1); i <= 200; i++ {
+		scores[i] = rng.Int63n(50)
+		keys[i] = LivestreamRankingEntry{LivestreamID: i, Score: scores[i]}
+	}
+	idx.reset(keys)
+
+	for step := 0; step < 2000; step++ {
+		id := rng.Int63n(200) + 1
+		delta := rng.Int63n(21) - 10
+		idx.add(id, delta)
+		scores[id] += delta
+
+		if step%100 != 0 {
+			continue
+		}
+		for id, score := range scores {
+			// 素朴に数えた順位と一致する
+			want := int64(1)
+			for otherID, otherScore := range scores {
+				if otherScore > score || (otherScore == score && otherID > id) {
+					want++
+				}
+			}
+			if got := idx.rank(id, LivestreamRankingEntry{}); got != want {
+				t.Fatalf("step %d: rank(%d) = %d, want %d", step, id, got, want)
+			}
+		}
+	}
+}
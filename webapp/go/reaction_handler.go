@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -120,10 +122,7 @@ func getReactionsHandler(c echo.Context) error {
 		for _, userModel := range userModels {
 			theme := Theme{}
 			if userThemes, ok := themesByUserID[userModel.ID]; ok && len(userThemes) > 0 {
-				theme = Theme{
-					ID:       userThemes[0].ID,
-					DarkMode: userThemes[0].DarkMode,
-				}
+				theme = fillThemeResponse(userThemes[0])
 			}
 
 			iconHash := "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
@@ -132,12 +131,14 @@ func getReactionsHandler(c echo.Context) error {
 			}
 
 			user := User{
-				ID:          userModel.ID,
-				Name:        userModel.Name,
-				DisplayName: userModel.DisplayName,
-				Description: userModel.Description,
-				Theme:       theme,
-				IconHash:    iconHash,
+				ID:             userModel.ID,
+				Name:           userModel.Name,
+				DisplayName:    userModel.DisplayName,
+				Description:    userModel.Description,
+				Theme:          theme,
+				IconHash:       iconHash,
+				FollowersCount: userModel.FollowersCount,
+				FollowingCount: userModel.FollowingCount,
 			}
 
 			users[user.ID] = user
@@ -199,6 +200,17 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := checkLivestreamOpen(livestreamModel, time.Now().Unix()); err != nil {
+		return err
+	}
+
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -215,15 +227,13 @@ func postReactionHandler(c echo.Context) error {
 	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET reactions_count = reactions_count + 1 WHERE id = ?", livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to increment reactions_count: "+err.Error())
 	}
-	// livestreamsを取得
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-	}
 	// usersのreactions_countをインクリメント
 	if _, err := tx.ExecContext(ctx, "UPDATE users SET reactions_count = reactions_count + 1 WHERE id = ?", livestreamModel.UserID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to increment reactions_count: "+err.Error())
 	}
+	if err := addStats(ctx, tx, livestreamModel.ID, livestreamModel.UserID, StatsCounters{Reactions: 1}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update stats: "+err.Error())
+	}
 
 	reactionID, err := result.LastInsertId()
 	if err != nil {
@@ -236,10 +246,19 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
+	// 配信者のWebhookに送信
+	if err := enqueueWebhookEvent(ctx, tx, reaction.Livestream.Owner.ID, webhookEventReaction, reaction); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	trending.record(time.Unix(reaction.CreatedAt, 0), reaction.Livestream.ID, tagIDsOf(reaction.Livestream.Tags), trendingReactionPoints)
+	livestreamRankingIndex.add(reaction.Livestream.ID, 1)
+	userRankingIndex.add(reaction.Livestream.Owner.ID, 1)
+
 	return c.JSON(http.StatusCreated, reaction)
 }
 
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRecommendedLivestreamsLimit = 20
+	maxRecommendedLivestreamsLimit     = 100
+	// スコアを計算する候補の配信数 (新しいものから)
+	recommendationCandidatesLimit = 1000
+)
+
+// 配信ごとの行動の重み
+const (
+	recommendationViewWeight     = 1.0
+	recommendationReactionWeight = 2.0
+	recommendationCommentWeight  = 3.0
+	// チップ1000あたりの重み
+	recommendationTipWeight = 1.0
+	// フォロー中の配信者への重み
+	recommendationFollowWeight = 10.0
+)
+
+// スコアの各要素の重み
+const (
+	recommendationTagScoreWeight        = 3.0
+	recommendationOwnerScoreWeight      = 2.0
+	recommendationPopularityScoreWeight = 1.0
+	recommendationLiveBonus             = 0.5
+	recommendationScheduledBonus        = 0.2
+	// 既に見たことのある配信は新しい配信より優先度を下げる
+	recommendationSeenPenalty = 0.5
+)
+
+type livestreamInteraction struct {
+	LivestreamID int64 `db:"livestream_id"`
+	Count        int64 `db:"count"`
+	Tip          int64 `db:"tip"`
+}
+
+// userPreference はユーザーの視聴・リアクション・コメント履歴から求めた好み
+type userPreference struct {
+	tagWeights        map[int64]float64
+	ownerWeights      map[int64]float64
+	totalTagWeight    float64
+	totalOwnerWeight  float64
+	seenLivestreamIDs map[int64]struct{}
+}
+
+func (p *userPreference) isColdStart() bool {
+	return p.totalTagWeight == 0 && p.totalOwnerWeight == 0
+}
+
+// おすすめ配信一覧API
+// 履歴のないユーザーには人気順に返す
+// GET /api/livestream/recommended
+func getRecommendedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultRecommendedLivestreamsLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxRecommendedLivestreamsLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer between 1 and 100")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	preference, err := getUserPreference(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user preference: "+err.Error())
+	}
+
+	var candidates []*LivestreamModel
+	if err := tx.SelectContext(ctx, &candidates, "SELECT * FROM livestreams WHERE user_id != ? AND status != ? ORDER BY id DESC LIMIT ?", userID, livestreamStatusCancelled, recommendationCandidatesLimit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	candidateTagIDs, err := getLivestreamTagIDs(ctx, tx, candidates)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	scores := scoreRecommendationCandidates(preference, candidates, candidateTagIDs)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].ID] > scores[candidates[j].ID]
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	livestreams, err := fillLivestreamsResponse(ctx, tx, candidates)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// getUserPreference は視聴履歴・リアクション・コメントから、タグと配信者ごとの好みの重みを求める
+func getUserPreference(ctx context.Context, tx *sqlx.Tx, userID int64) (*userPreference, error) {
+	weights := make(map[int64]float64)
+
+	var views []*livestreamInteraction
+	if err := tx.SelectContext(ctx, &views, "SELECT livestream_id, COUNT(*) AS count, 0 AS tip FROM livestream_viewers_history WHERE user_id = ? GROUP BY livestream_id", userID); err != nil {
+		return nil, err
+	}
+	for _, v := range views {
+		weights[v.LivestreamID] += recommendationViewWeight * float64(v.Count)
+	}
+
+	var reactions []*livestreamInteraction
+	if err := tx.SelectContext(ctx, &reactions, "SELECT livestream_id, COUNT(*) AS count, 0 AS tip FROM reactions WHERE user_id = ? GROUP BY livestream_id", userID); err != nil {
+		return nil, err
+	}
+	for _, r := range reactions {
+		weights[r.LivestreamID] += recommendationReactionWeight * float64(r.Count)
+	}
+
+	var comments []*livestreamInteraction
+	if err := tx.SelectContext(ctx, &comments, "SELECT livestream_id, COUNT(*) AS count, IFNULL(SUM(tip), 0) AS tip FROM livecomments WHERE user_id = ? AND hidden_at IS NULL GROUP BY livestream_id", userID); err != nil {
+		return nil, err
+	}
+	for _, lc := range comments {
+		weights[lc.LivestreamID] += recommendationCommentWeight*float64(lc.Count) + recommendationTipWeight*float64(lc.Tip)/1000
+	}
+
+	preference := &userPreference{
+		tagWeights:        make(map[int64]float64),
+		ownerWeights:      make(map[int64]float64),
+		seenLivestreamIDs: make(map[int64]struct{}, len(weights)),
+	}
+
+	var followeeIDs []int64
+	if err := tx.SelectContext(ctx, &followeeIDs, "SELECT followee_id FROM follows WHERE follower_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, followeeID := range followeeIDs {
+		preference.ownerWeights[followeeID] += recommendationFollowWeight
+		preference.totalOwnerWeight += recommendationFollowWeight
+	}
+
+	if len(weights) == 0 {
+		return preference, nil
+	}
+
+	livestreamIDs := make([]int64, 0, len(weights))
+	for livestreamID := range weights {
+		livestreamIDs = append(livestreamIDs, livestreamID)
+		preference.seenLivestreamIDs[livestreamID] = struct{}{}
+	}
+
+	var interactedLivestreams []*LivestreamModel
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &interactedLivestreams, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, livestreamModel := range interactedLivestreams {
+		// 自分の配信への行動は好みに含めない
+		if livestreamModel.UserID == userID {
+			continue
+		}
+		preference.ownerWeights[livestreamModel.UserID] += weights[livestreamModel.ID]
+		preference.totalOwnerWeight += weights[livestreamModel.ID]
+	}
+
+	tagIDs, err := getLivestreamTagIDs(ctx, tx, interactedLivestreams)
+	if err != nil {
+		return nil, err
+	}
+	for _, livestreamModel := range interactedLivestreams {
+		if livestreamModel.UserID == userID {
+			continue
+		}
+		for _, tagID := range tagIDs[livestreamModel.ID] {
+			preference.tagWeights[tagID] += weights[livestreamModel.ID]
+			preference.totalTagWeight += weights[livestreamModel.ID]
+		}
+	}
+
+	return preference, nil
+}
+
+// getLivestreamTagIDs は配信IDごとのタグIDをまとめて取得する
+func getLivestreamTagIDs(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel) (map[int64][]int64, error) {
+	tagIDs := make(map[int64][]int64, len(livestreamModels))
+	if len(livestreamModels) == 0 {
+		return tagIDs, nil
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		livestreamIDs[i] = livestreamModels[i].ID
+	}
+
+	var livestreamTags []*LivestreamTagModel
+	query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &livestreamTags, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, livestreamTag := range livestreamTags {
+		tagIDs[livestreamTag.LivestreamID] = append(tagIDs[livestreamTag.LivestreamID], livestreamTag.TagID)
+	}
+
+	return tagIDs, nil
+}
+
+// scoreRecommendationCandidates は候補の配信ごとのスコアを求める
+// 履歴がない場合は人気度と配信状態のみで順位付けする
+func scoreRecommendationCandidates(preference *userPreference, candidates []*LivestreamModel, candidateTagIDs map[int64][]int64) map[int64]float64 {
+	var maxPopularity float64
+	for _, candidate := range candidates {
+		maxPopularity = math.Max(maxPopularity, livestreamPopularity(candidate))
+	}
+
+	now := time.Now().Unix()
+	scores := make(map[int64]float64, len(candidates))
+	for _, candidate := range candidates {
+		var score float64
+		if maxPopularity > 0 {
+			score += recommendationPopularityScoreWeight * livestreamPopularity(candidate) / maxPopularity
+		}
+		switch livestreamEffectiveStatus(*candidate, now) {
+		case livestreamStatusLive:
+			score += recommendationLiveBonus
+		case livestreamStatusScheduled:
+			score += recommendationScheduledBonus
+		}
+
+		if !preference.isColdStart() {
+			if preference.totalTagWeight > 0 {
+				var tagWeight float64
+				for _, tagID := range candidateTagIDs[candidate.ID] {
+					tagWeight += preference.tagWeights[tagID]
+				}
+				score += recommendationTagScoreWeight * tagWeight / preference.totalTagWeight
+			}
+			if preference.totalOwnerWeight > 0 {
+				score += recommendationOwnerScoreWeight * preference.ownerWeights[candidate.UserID] / preference.totalOwnerWeight
+			}
+			if _, ok := preference.seenLivestreamIDs[candidate.ID]; ok {
+				score *= recommendationSeenPenalty
+			}
+		}
+
+		scores[candidate.ID] = score
+	}
+
+	return scores
+}
+
+// livestreamPopularity は大きな配信に引きずられないよう、リアクション数とチップの合計を対数にする
+func livestreamPopularity(livestreamModel *LivestreamModel) float64 {
+	return math.Log1p(float64(livestreamModel.ReactionsCount + livestreamModel.Tip))
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 予約枠は1時間単位
+	reservationSlotDuration int64 = 60 * 60
+	// 繰り返し予約で一度に作成できる回数の上限
+	maxRecurrenceOccurrences = 53
+)
+
+// 繰り返し予約の頻度
+const (
+	recurrenceFrequencyDaily  = "daily"
+	recurrenceFrequencyWeekly = "weekly"
+)
+
+var recurrenceIntervals = map[string]int64{
+	recurrenceFrequencyDaily:  24 * 60 * 60,
+	recurrenceFrequencyWeekly: 7 * 24 * 60 * 60,
+}
+
+// ReservationRecurrence は繰り返し予約のルール
+// countとuntilの両方を指定した場合は、先に到達した方で終了する
+type ReservationRecurrence struct {
+	Frequency string `json:"frequency"`
+	Count     int64  `json:"count"`
+	// 最後の回の開始日時 (この日時以前に開始する回まで予約する)
+	Until int64 `json:"until"`
+	// trueの場合は予約できない回を飛ばして残りを予約する。falseの場合は1回でも予約できなければ何も予約しない
+	SkipConflicts bool `json:"skip_conflicts"`
+}
+
+type ReservationConflict struct {
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	Reason  string `json:"reason"`
+}
+
+type ReserveRecurringLivestreamResponse struct {
+	SeriesID    int64                 `json:"series_id,omitempty"`
+	Livestreams []Livestream          `json:"livestreams"`
+	Conflicts   []ReservationConflict `json:"conflicts"`
+}
+
+type LivestreamSeriesModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Frequency string `db:"frequency"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type UpdateLivestreamSeriesRequest struct {
+	Tags         []int64 `json:"tags"`
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	PlaylistUrl  string  `json:"playlist_url"`
+	ThumbnailUrl string  `json:"thumbnail_url"`
+}
+
+type PostReservationSlotsRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 省略時は設定された予約枠あたりの同時配信数を使う
+	Capacity int64 `json:"capacity"`
+}
+
+type PostReservationSlotsResponse struct {
+	CreatedCount int64 `json:"created_count"`
+	SkippedCount int64 `json:"skipped_count"`
+}
+
+// 予約枠生成API (管理者向け)
+// 指定期間の1時間ごとの予約枠を作成する。既に存在する予約枠はそのまま残す
+// POST /api/admin/reservation_slots
+func postReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostReservationSlotsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	// 予約可能期間より先の予約枠も作れるように、期間内かどうかは確認しない
+	if err := validateReservationSlotRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	if req.Capacity < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "capacity must not be negative")
+	}
+	capacity := req.Capacity
+	if capacity == 0 {
+		capacity = reservationSlotCapacity
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var existingStartAts []int64
+	if err := tx.SelectContext(ctx, &existingStartAts, "SELECT start_at FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	existing := make(map[int64]struct{}, len(existingStartAts))
+	for _, startAt := range existingStartAts {
+		existing[startAt] = struct{}{}
+	}
+
+	var slots []*ReservationSlotModel
+	for startAt := req.StartAt; startAt < req.EndAt; startAt += reservationSlotDuration {
+		if _, ok := existing[startAt]; ok {
+			continue
+		}
+		slots = append(slots, &ReservationSlotModel{
+			Slot:    capacity,
+			StartAt: startAt,
+			EndAt:   startAt + reservationSlotDuration,
+		})
+	}
+
+	if len(slots) > 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", slots); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_slots: "+err.Error())
+		}
+	}
+
+	// 新しい予約枠にキャンセル待ちを割り当てる
+	bookedLivestreamModels, err := processReservationWaitlist(ctx, tx, req.StartAt, req.EndAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addLivestreamsToRanking(bookedLivestreamModels)
+
+	return c.JSON(http.StatusCreated, &PostReservationSlotsResponse{
+		CreatedCount: int64(len(slots)),
+		SkippedCount: int64(len(existingStartAts)),
+	})
+}
+
+// validateReservationSlotRange は区間が空でなく、予約枠の境界に揃っていることを確認する
+func validateReservationSlotRange(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if startAt%reservationSlotDuration != 0 || endAt%reservationSlotDuration != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("start_at and end_at must be aligned to %d seconds", reservationSlotDuration))
+	}
+	return nil
+}
+
+// validateReservationRange は予約区間が予約枠の境界に揃っていて、予約可能期間と重なっていることを確認する
+func validateReservationRange(startAt, endAt int64) error {
+	if err := validateReservationSlotRange(startAt, endAt); err != nil {
+		return err
+	}
+
+	reserveStartAt := time.Unix(startAt, 0)
+	reserveEndAt := time.Unix(endAt, 0)
+	if !reserveStartAt.Before(reservationTermEndAt) || !reserveEndAt.After(reservationTermStartAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+
+	return nil
+}
+
+// consumeReservationSlots は予約区間の予約枠をロックし、全ての枠に空きがあれば1つずつ消費する
+// 空きがない場合は何も変更せずに400を返す
+func consumeReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if int64(len(slots)) != (endAt-startAt)/reservationSlotDuration {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約区間 %d ~ %dには予約枠が用意されていない時間帯があります", startAt, endAt))
+	}
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", reservationTermStartAt.Unix(), reservationTermEndAt.Unix(), startAt, endAt))
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// releaseReservationSlots は予約区間の予約枠を1つずつ返却し、空いた枠をキャンセル待ちに割り当てる
+// キャンセル待ちから作成した配信を返す
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) ([]*LivestreamModel, error) {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return processReservationWaitlist(ctx, tx, startAt, endAt)
+}
+
+// reserveRecurringLivestreams は繰り返しルールに従って全ての回を同じトランザクションで予約する
+func reserveRecurringLivestreams(c echo.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, tagIDs []int64) error {
+	ctx := c.Request().Context()
+
+	startAts, err := recurrenceStartAts(req.StartAt, *req.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:    userID,
+		Frequency: req.Recurrence.Frequency,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, frequency, created_at) VALUES (:user_id, :frequency, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	duration := req.EndAt - req.StartAt
+	var livestreamModels []*LivestreamModel
+	conflicts := []ReservationConflict{}
+	for _, startAt := range startAts {
+		endAt := startAt + duration
+		err := validateReservationRange(startAt, endAt)
+		if err == nil {
+			err = consumeReservationSlots(ctx, tx, startAt, endAt)
+		}
+		if err != nil {
+			var he *echo.HTTPError
+			if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+				return err
+			}
+			conflicts = append(conflicts, ReservationConflict{
+				StartAt: startAt,
+				EndAt:   endAt,
+				Reason:  fmt.Sprint(he.Message),
+			})
+			continue
+		}
+
+		livestreamModel := &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      startAt,
+			EndAt:        endAt,
+			Status:       livestreamStatusScheduled,
+			SeriesID:     sql.NullInt64{Int64: seriesID, Valid: true},
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+			return err
+		}
+		livestreamModels = append(livestreamModels, livestreamModel)
+	}
+
+	// 一部でも予約できない回があれば、ロールバックして衝突した回を返す
+	if len(livestreamModels) == 0 || (len(conflicts) > 0 && !req.Recurrence.SkipConflicts) {
+		return c.JSON(http.StatusConflict, &ReserveRecurringLivestreamResponse{
+			Livestreams: []Livestream{},
+			Conflicts:   conflicts,
+		})
+	}
+
+	// 繰り返し予約は初回の配信のみフォロワーに通知する
+	if err := notifyFollowers(ctx, tx, notificationTypeLivestreamReserved, *livestreamModels[0]); err != nil {
+		return err
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addLivestreamsToRanking(livestreamModels)
+
+	return c.JSON(http.StatusCreated, &ReserveRecurringLivestreamResponse{
+		SeriesID:    seriesID,
+		Livestreams: livestreams,
+		Conflicts:   conflicts,
+	})
+}
+
+// recurrenceStartAts は繰り返しルールから各回の開始日時を求める
+func recurrenceStartAts(startAt int64, recurrence ReservationRecurrence) ([]int64, error) {
+	interval, ok := recurrenceIntervals[recurrence.Frequency]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence frequency must be daily or weekly")
+	}
+	if recurrence.Count <= 0 && recurrence.Until <= 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence requires count or until")
+	}
+	if recurrence.Count > maxRecurrenceOccurrences {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("recurrence count must be at most %d", maxRecurrenceOccurrences))
+	}
+	if recurrence.Until > 0 && recurrence.Until < startAt {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence until must not be before start_at")
+	}
+
+	var startAts []int64
+	for t := startAt; ; t += interval {
+		if recurrence.Count > 0 && int64(len(startAts)) >= recurrence.Count {
+			break
+		}
+		if recurrence.Until > 0 && t > recurrence.Until {
+			break
+		}
+		if len(startAts) >= maxRecurrenceOccurrences {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("recurrence must have at most %d occurrences", maxRecurrenceOccurrences))
+		}
+		startAts = append(startAts, t)
+	}
+	return startAts, nil
+}
+
+// 繰り返し予約の今後の回をまとめて更新するAPI
+// PUT /api/livestream/series/:series_id
+func updateLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := getUpcomingSeriesLivestreams(ctx, tx, userID, seriesID)
+	if err != nil {
+		return err
+	}
+
+	tagIDs, err := normalizeLivestreamTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return err
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamModel.Title = req.Title
+		livestreamModel.Description = req.Description
+		livestreamModel.PlaylistUrl = req.PlaylistUrl
+		livestreamModel.ThumbnailUrl = req.ThumbnailUrl
+		if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, sequence = sequence + 1 WHERE id = :id", livestreamModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		for _, tagID := range tagIDs {
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+				LivestreamID: livestreamModel.ID,
+				TagID:        tagID,
+			}); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+			}
+		}
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// 繰り返し予約の今後の回をまとめて取り消すAPI
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := getUpcomingSeriesLivestreams(ctx, tx, userID, seriesID)
+	if err != nil {
+		return err
+	}
+
+	var bookedLivestreamModels []*LivestreamModel
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ?, sequence = sequence + 1 WHERE id = ?", livestreamStatusCancelled, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+		}
+		livestreamModel.Status = livestreamStatusCancelled
+		booked, err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+		if err != nil {
+			return err
+		}
+		bookedLivestreamModels = append(bookedLivestreamModels, booked...)
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addLivestreamsToRanking(bookedLivestreamModels)
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// getUpcomingSeriesLivestreams は配信者自身の繰り返し予約のうち、まだ開始していない回をロックして返す
+func getUpcomingSeriesLivestreams(ctx context.Context, tx *sqlx.Tx, userID, seriesID int64) ([]*LivestreamModel, error) {
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found livestream series that has the given id")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's livestream series")
+	}
+
+	var livestreamModels []*LivestreamModel
+	query := "SELECT * FROM livestreams WHERE series_id = ? AND status = ? AND start_at > ? ORDER BY start_at FOR UPDATE"
+	if err := tx.SelectContext(ctx, &livestreamModels, query, seriesID, livestreamStatusScheduled, time.Now().Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	return livestreamModels, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRecurrenceStartAts(t *testing.T) {
+	const (
+		day     int64 = 24 * 60 * 60
+		week          = 7 * day
+		startAt int64 = 1700874000
+	)
+
+	weeklyMax := make([]int64, maxRecurrenceOccurrences)
+	for i := range weeklyMax {
+		weeklyMax[i] = startAt + int64(i)*week
+	}
+
+	tests := []struct {
+		name       string
+		recurrence ReservationRecurrence
+		want       []int64
+		wantErr    bool
+	}{
+		{
+			name:       "daily count",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Count: 3},
+			want:       []int64{startAt, startAt + day, startAt + 2*day},
+		},
+		{
+			name:       "weekly count",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyWeekly, Count: 2},
+			want:       []int64{startAt, startAt + week},
+		},
+		{
+			name:       "until is inclusive",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Until: startAt + 2*day},
+			want:       []int64{startAt, startAt + day, startAt + 2*day},
+		},
+		{
+			name:       "until between occurrences",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyWeekly, Until: startAt + week + day},
+			want:       []int64{startAt, startAt + week},
+		},
+		{
+			name:       "until equal to start_at",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Until: startAt},
+			want:       []int64{startAt},
+		},
+		{
+			name:       "count reached before until",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Count: 2, Until: startAt + 10*day},
+			want:       []int64{startAt, startAt + day},
+		},
+		{
+			name:       "until reached before count",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Count: 10, Until: startAt + day},
+			want:       []int64{startAt, startAt + day},
+		},
+		{
+			name:       "maximum count",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyWeekly, Count: maxRecurrenceOccurrences},
+			want:       weeklyMax,
+		},
+		{
+			name:       "count over maximum",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyWeekly, Count: maxRecurrenceOccurrences + 1},
+			wantErr:    true,
+		},
+		{
+			name:       "until over maximum occurrences",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Until: startAt + maxRecurrenceOccurrences*day},
+			wantErr:    true,
+		},
+		{
+			name:       "until before start_at",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily, Until: startAt - day},
+			wantErr:    true,
+		},
+		{
+			name:       "neither count nor until",
+			recurrence: ReservationRecurrence{Frequency: recurrenceFrequencyDaily},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown frequency",
+			recurrence: ReservationRecurrence{Frequency: "monthly", Count: 2},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := recurrenceStartAts(startAt, tt.recurrence)
+			if tt.wantErr {
+				var httpErr *echo.HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+					t.Fatalf("recurrenceStartAts() error = %v, want 400", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("recurrenceStartAts() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("recurrenceStartAts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
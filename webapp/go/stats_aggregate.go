@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// StatsCounters は配信・配信者の統計の集計値
+// 書き込み時にaddStatsで更新し、computeStatsで元のテーブルから求め直せる
+type StatsCounters struct {
+	Livecomments int64 `db:"livecomments"`
+	Tip          int64 `db:"tip"`
+	MaxTip       int64 `db:"max_tip"`
+	Reactions    int64 `db:"reactions"`
+	Reports      int64 `db:"reports"`
+	// livestream_viewers_historyの件数
+	Viewers int64 `db:"viewers"`
+}
+
+type LivestreamStatsModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	StatsCounters
+}
+
+type UserStatsModel struct {
+	UserID int64 `db:"user_id"`
+	StatsCounters
+}
+
+// 一度にINSERTする行数
+const statsInsertBatchSize = 1000
+
+const statsUpsertUpdate = `
+	ON DUPLICATE KEY UPDATE
+		livecomments = livecomments + VALUES(livecomments),
+		tip = tip + VALUES(tip),
+		max_tip = GREATEST(max_tip, VALUES(max_tip)),
+		reactions = reactions + VALUES(reactions),
+		reports = reports + VALUES(reports),
+		viewers = viewers + VALUES(viewers)
+	`
+
+// addStats は配信と配信者の集計値にdeltaを加える。MaxTipは大きい方を残す
+// 行がなければ作成する
+func addStats(ctx context.Context, tx *sqlx.Tx, livestreamID, ownerID int64, delta StatsCounters) error {
+	query := "INSERT INTO livestream_stats (livestream_id, livecomments, tip, max_tip, reactions, reports, viewers) VALUES (?, ?, ?, ?, ?, ?, ?)" + statsUpsertUpdate
+	if _, err := tx.ExecContext(ctx, query, livestreamID, delta.Livecomments, delta.Tip, delta.MaxTip, delta.Reactions, delta.Reports, delta.Viewers); err != nil {
+		return fmt.Errorf("failed to update livestream stats: %w", err)
+	}
+	query = "INSERT INTO user_stats (user_id, livecomments, tip, max_tip, reactions, reports, viewers) VALUES (?, ?, ?, ?, ?, ?, ?)" + statsUpsertUpdate
+	if _, err := tx.ExecContext(ctx, query, ownerID, delta.Livecomments, delta.Tip, delta.MaxTip, delta.Reactions, delta.Reports, delta.Viewers); err != nil {
+		return fmt.Errorf("failed to update user stats: %w", err)
+	}
+	return nil
+}
+
+// refreshMaxTip はライブコメントが削除・復元された後に、配信と配信者の最大チップ額を求め直す
+func refreshMaxTip(ctx context.Context, tx *sqlx.Tx, livestreamID, ownerID int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_stats SET max_tip = (SELECT IFNULL(MAX(tip), 0) FROM livecomments WHERE livestream_id = ? AND hidden_at IS NULL) WHERE livestream_id = ?", livestreamID, livestreamID); err != nil {
+		return fmt.Errorf("failed to refresh livestream max tip: %w", err)
+	}
+	query := "UPDATE user_stats SET max_tip = (SELECT IFNULL(MAX(s.max_tip), 0) FROM livestream_stats s INNER JOIN livestreams l ON l.id = s.livestream_id WHERE l.user_id = ?) WHERE user_id = ?"
+	if _, err := tx.ExecContext(ctx, query, ownerID, ownerID); err != nil {
+		return fmt.Errorf("failed to refresh user max tip: %w", err)
+	}
+	return nil
+}
+
+// adjustLivecommentCounters はライブコメントの削除・復元に合わせて、依存する全ての集計値を更新する
+// deltaはLivecommentsとTipのみ使い、削除の場合は負の値を渡す
+// ランキングはコミット後に呼び出し元で更新する
+func adjustLivecommentCounters(ctx context.Context, tx *sqlx.Tx, livestreamID, ownerID int64, delta StatsCounters) error {
+	if delta.Livecomments == 0 {
+		return nil
+	}
+	if err := addStats(ctx, tx, livestreamID, ownerID, StatsCounters{
+		Livecomments: delta.Livecomments,
+		Tip:          delta.Tip,
+	}); err != nil {
+		return err
+	}
+	if err := refreshMaxTip(ctx, tx, livestreamID, ownerID); err != nil {
+		return err
+	}
+
+	if delta.Tip != 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET tip = tip + ? WHERE id = ?", delta.Tip, livestreamID); err != nil {
+			return fmt.Errorf("failed to update livestream tip: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET tip = tip + ? WHERE id = ?", delta.Tip, ownerID); err != nil {
+			return fmt.Errorf("failed to update user tip: %w", err)
+		}
+	}
+	return nil
+}
+
+func getLivestreamStats(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (StatsCounters, error) {
+	var stats LivestreamStatsModel
+	if err := tx.GetContext(ctx, &stats, "SELECT * FROM livestream_stats WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return StatsCounters{}, nil
+		}
+		return StatsCounters{}, err
+	}
+	return stats.StatsCounters, nil
+}
+
+func getUserStats(ctx context.Context, tx *sqlx.Tx, userID int64) (StatsCounters, error) {
+	var stats UserStatsModel
+	if err := tx.GetContext(ctx, &stats, "SELECT * FROM user_stats WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return StatsCounters{}, nil
+		}
+		return StatsCounters{}, err
+	}
+	return stats.StatsCounters, nil
+}
+
+// getStatsForUpdate は集計値のテーブルを全てロックして読む
+// 集計値はaddStatsと元のテーブルへの書き込みが同じトランザクションで更新されるので、
+// computeStatsより先に呼ぶと、以降のスナップショットには集計値に反映済みの書き込みだけが含まれる
+// (スナップショットはロックを伴わない最初のSELECTの時点で作られる)
+func getStatsForUpdate(ctx context.Context, tx *sqlx.Tx) ([]*LivestreamStatsModel, []*UserStatsModel, error) {
+	var livestreamStats []*LivestreamStatsModel
+	if err := tx.SelectContext(ctx, &livestreamStats, "SELECT * FROM livestream_stats ORDER BY livestream_id FOR UPDATE"); err != nil {
+		return nil, nil, fmt.Errorf("failed to lock livestream stats: %w", err)
+	}
+	var userStats []*UserStatsModel
+	if err := tx.SelectContext(ctx, &userStats, "SELECT * FROM user_stats ORDER BY user_id FOR UPDATE"); err != nil {
+		return nil, nil, fmt.Errorf("failed to lock user stats: %w", err)
+	}
+	return livestreamStats, userStats, nil
+}
+
+// computeStats は元のテーブルから全ての配信と配信者の集計値を求める
+func computeStats(ctx context.Context, tx *sqlx.Tx) ([]*LivestreamStatsModel, []*UserStatsModel, error) {
+	type livestreamStatsRow struct {
+		LivestreamStatsModel
+		UserID int64 `db:"user_id"`
+	}
+
+	query := `
+	SELECT
+		l.id AS livestream_id, l.user_id,
+		IFNULL(c.livecomments, 0) AS livecomments, IFNULL(c.tip, 0) AS tip, IFNULL(c.max_tip, 0) AS max_tip,
+		IFNULL(r.reactions, 0) AS reactions, IFNULL(rp.reports, 0) AS reports, IFNULL(v.viewers, 0) AS viewers
+	FROM livestreams l
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS livecomments, SUM(tip) AS tip, MAX(tip) AS max_tip FROM livecomments WHERE hidden_at IS NULL GROUP BY livestream_id
+	) c ON c.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS reactions FROM reactions GROUP BY livestream_id
+	) r ON r.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS reports FROM livecomment_reports GROUP BY livestream_id
+	) rp ON rp.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS viewers FROM livestream_viewers_history GROUP BY livestream_id
+	) v ON v.livestream_id = l.id
+	ORDER BY l.id
+	`
+	var rows []*livestreamStatsRow
+	if err := tx.SelectContext(ctx, &rows, query); err != nil {
+		return nil, nil, fmt.Errorf("failed to compute livestream stats: %w", err)
+	}
+
+	var userIDs []int64
+	if err := tx.SelectContext(ctx, &userIDs, "SELECT id FROM users ORDER BY id"); err != nil {
+		return nil, nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	userStats := make([]*UserStatsModel, len(userIDs))
+	userStatsByID := make(map[int64]*UserStatsModel, len(userIDs))
+	for i, userID := range userIDs {
+		userStats[i] = &UserStatsModel{UserID: userID}
+		userStatsByID[userID] = userStats[i]
+	}
+
+	livestreamStats := make([]*LivestreamStatsModel, len(rows))
+	for i, row := range rows {
+		livestreamStats[i] = &row.LivestreamStatsModel
+		s, ok := userStatsByID[row.UserID]
+		if !ok {
+			continue
+		}
+		s.Livecomments += row.Livecomments
+		s.Tip += row.Tip
+		s.MaxTip = max(s.MaxTip, row.MaxTip)
+		s.Reactions += row.Reactions
+		s.Reports += row.Reports
+		s.Viewers += row.Viewers
+	}
+
+	return livestreamStats, userStats, nil
+}
+
+// replaceStats は集計値のテーブルを全て置き換える
+func replaceStats(ctx context.Context, tx *sqlx.Tx, livestreamStats []*LivestreamStatsModel, userStats []*UserStatsModel) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_stats"); err != nil {
+		return fmt.Errorf("failed to delete livestream stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_stats"); err != nil {
+		return fmt.Errorf("failed to delete user stats: %w", err)
+	}
+
+	for i := 0; i < len(livestreamStats); i += statsInsertBatchSize {
+		batch := livestreamStats[i:min(i+statsInsertBatchSize, len(livestreamStats))]
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_stats (livestream_id, livecomments, tip, max_tip, reactions, reports, viewers) VALUES (:livestream_id, :livecomments, :tip, :max_tip, :reactions, :reports, :viewers)", batch); err != nil {
+			return fmt.Errorf("failed to insert livestream stats: %w", err)
+		}
+	}
+	for i := 0; i < len(userStats); i += statsInsertBatchSize {
+		batch := userStats[i:min(i+statsInsertBatchSize, len(userStats))]
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO user_stats (user_id, livecomments, tip, max_tip, reactions, reports, viewers) VALUES (:user_id, :livecomments, :tip, :max_tip, :reactions, :reports, :viewers)", batch); err != nil {
+			return fmt.Errorf("failed to insert user stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebuildStats は集計値のテーブルを元のテーブルから作り直す
+func rebuildStats(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, _, err := getStatsForUpdate(ctx, tx); err != nil {
+		return err
+	}
+	livestreamStats, userStats, err := computeStats(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := replaceStats(ctx, tx, livestreamStats, userStats); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -13,9 +14,14 @@ import (
 type LivestreamStatistics struct {
 	Rank           int64 `json:"rank"`
 	ViewersCount   int64 `json:"viewers_count"`
+	CurrentViewers int64 `json:"current_viewers"`
+	PeakViewers    int64 `json:"peak_viewers"`
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// 視聴時間 (秒)。平均は視聴者1人あたり
+	TotalWatchTime   int64 `json:"total_watch_time"`
+	AverageWatchTime int64 `json:"average_watch_time"`
 }
 
 type LivestreamRankingEntry struct {
@@ -34,6 +40,49 @@ func (r LivestreamRanking) Less(i, j int) bool {
 	}
 }
 
+const (
+	defaultTimeseriesBucketSeconds = 60
+	minTimeseriesBucketSeconds     = 10
+	maxTimeseriesBuckets           = 10000
+)
+
+type LivestreamTimeseriesPoint struct {
+	StartAt      int64 `json:"start_at"`
+	Livecomments int64 `json:"livecomments"`
+	Reactions    int64 `json:"reactions"`
+	Tips         int64 `json:"tips"`
+	Viewers      int64 `json:"viewers"`
+}
+
+type LivestreamTimeseries struct {
+	LivestreamID int64                       `json:"livestream_id"`
+	Bucket       int64                       `json:"bucket"`
+	StartAt      int64                       `json:"start_at"`
+	EndAt        int64                       `json:"end_at"`
+	Points       []LivestreamTimeseriesPoint `json:"points"`
+}
+
+type LivestreamRetentionPoint struct {
+	// 視聴開始からの経過秒数
+	Elapsed int64 `json:"elapsed"`
+	Viewers int64 `json:"viewers"`
+	// 全視聴者のうち、Elapsed秒以上視聴した割合
+	Ratio float64 `json:"ratio"`
+}
+
+type LivestreamRetention struct {
+	LivestreamID int64                      `json:"livestream_id"`
+	Bucket       int64                      `json:"bucket"`
+	Viewers      int64                      `json:"viewers"`
+	Points       []LivestreamRetentionPoint `json:"points"`
+}
+
+type timeseriesBucketCount struct {
+	Index int64 `db:"idx"`
+	Count int64 `db:"count"`
+	Tip   int64 `db:"tip"`
+}
+
 type UserStatistics struct {
 	Rank              int64  `json:"rank"`
 	ViewersCount      int64  `json:"viewers_count"`
@@ -41,6 +90,9 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	// 全配信の視聴時間 (秒)。平均は配信ごとの視聴者1人あたり
+	TotalWatchTime   int64 `json:"total_watch_time"`
+	AverageWatchTime int64 `json:"average_watch_time"`
 }
 
 type UserRankingEntry struct {
@@ -87,74 +139,20 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	// ランク算出
-	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
-	}
-
-	var ranking UserRanking
-	for _, user := range users {
-		score := user.ReactionsCount + user.Tip
-		ranking = append(ranking, UserRankingEntry{
-			Username: user.Name,
-			Score:    score,
-		})
-	}
-	sort.Sort(ranking)
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.Username == username {
-			break
-		}
-		rank++
-	}
-
-	// リアクション数
-	var totalReactions int64
-	query := `SELECT COUNT(*) FROM users u
-    INNER JOIN livestreams l ON l.user_id = u.id
-    INNER JOIN reactions r ON r.livestream_id = l.id
-    WHERE u.name = ?
-	`
-	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
-	}
-
-	// ライブコメント数、チップ合計
-	var totalLivecomments int64
-	var totalTip int64
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-
-	for _, livestream := range livestreams {
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-		}
-
-		for _, livecomment := range livecomments {
-			totalTip += livecomment.Tip
-			totalLivecomments++
-		}
-	}
+	rank := userRankingIndex.rank(user.ID, UserRankingEntry{
+		Username: user.Name,
+		Score:    user.ReactionsCount + user.Tip,
+	})
 
-	// 合計視聴者数
-	var viewersCount int64
-	for _, livestream := range livestreams {
-		var cnt int64
-		if err := tx.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
-		}
-		viewersCount += cnt
+	// リアクション数、ライブコメント数、チップ合計、合計視聴者数
+	counters, err := getUserStats(ctx, tx, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user stats: "+err.Error())
 	}
 
 	// お気に入り絵文字
 	var favoriteEmoji string
-	query = `
+	query := `
 	SELECT r.emoji_name
 	FROM users u
 	INNER JOIN livestreams l ON l.user_id = u.id
@@ -168,13 +166,21 @@ func getUserStatisticsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
 	}
 
+	// 視聴時間
+	watchTime, err := getUserWatchTime(ctx, tx, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch time: "+err.Error())
+	}
+
 	stats := UserStatistics{
 		Rank:              rank,
-		ViewersCount:      viewersCount,
-		TotalReactions:    totalReactions,
-		TotalLivecomments: totalLivecomments,
-		TotalTip:          totalTip,
+		ViewersCount:      counters.Viewers,
+		TotalReactions:    counters.Reactions,
+		TotalLivecomments: counters.Livecomments,
+		TotalTip:          counters.Tip,
 		FavoriteEmoji:     favoriteEmoji,
+		TotalWatchTime:    watchTime.TotalWatchTime,
+		AverageWatchTime:  watchTime.averageWatchTime(),
 	}
 	return c.JSON(http.StatusOK, stats)
 }
@@ -207,64 +213,241 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		}
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// ランク算出
+	rank := livestreamRankingIndex.rank(livestream.ID, LivestreamRankingEntry{
+		LivestreamID: livestream.ID,
+		Score:        livestream.ReactionsCount + livestream.Tip,
+	})
+
+	// 視聴者数、最大チップ額、リアクション数、スパム報告数
+	counters, err := getLivestreamStats(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream stats: "+err.Error())
+	}
+
+	// 同時視聴者数
+	currentViewers, err := countCurrentViewers(ctx, tx, livestreamID, time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count current viewers: "+err.Error())
 	}
 
-	// ランク算出
-	var ranking LivestreamRanking
-	for _, livestream := range livestreams {
-		score := livestream.ReactionsCount + livestream.Tip
-		ranking = append(ranking, LivestreamRankingEntry{
-			LivestreamID: livestream.ID,
-			Score:        score,
-		})
-	}
-	sort.Sort(ranking)
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.LivestreamID == livestreamID {
-			break
+	// 視聴時間
+	watchTime, err := getLivestreamWatchTime(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch time: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamStatistics{
+		Rank:             rank,
+		ViewersCount:     counters.Viewers,
+		CurrentViewers:   currentViewers,
+		PeakViewers:      livestream.PeakViewers,
+		MaxTip:           counters.MaxTip,
+		TotalReactions:   counters.Reactions,
+		TotalReports:     counters.Reports,
+		TotalWatchTime:   watchTime.TotalWatchTime,
+		AverageWatchTime: watchTime.averageWatchTime(),
+	})
+}
+
+// 配信の時系列統計API
+// 配信時間をbucket秒ごとに区切り、コメント数・リアクション数・チップ合計・視聴者数を返す
+// GET /api/livestream/:livestream_id/statistics/timeseries
+func getLivestreamTimeseriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	var bucket int64 = defaultTimeseriesBucketSeconds
+	if c.QueryParam("bucket") != "" {
+		bucket, err = strconv.ParseInt(c.QueryParam("bucket"), 10, 64)
+		if err != nil || bucket < minTimeseriesBucketSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket query parameter must be integer greater than or equal to %d", minTimeseriesBucketSeconds))
 		}
-		rank++
 	}
 
-	// 視聴者数算出
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	// 最大チップ額
-	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	var livestream LivestreamModel
+	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	numBuckets := (livestream.EndAt - livestream.StartAt + bucket - 1) / bucket
+	if numBuckets > maxTimeseriesBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket is too small for this livestream (at most %d buckets)", maxTimeseriesBuckets))
+	}
+	points := make([]LivestreamTimeseriesPoint, numBuckets)
+	for i := range points {
+		points[i].StartAt = livestream.StartAt + int64(i)*bucket
+	}
+
+	// コメント数・チップ合計
+	var livecommentCounts []*timeseriesBucketCount
+	query := `
+	SELECT (created_at - ?) DIV ? AS idx, COUNT(*) AS count, IFNULL(SUM(tip), 0) AS tip FROM livecomments
+	WHERE livestream_id = ? AND created_at >= ? AND created_at < ? AND hidden_at IS NULL
+	GROUP BY idx
+	`
+	if err := tx.SelectContext(ctx, &livecommentCounts, query, livestream.StartAt, bucket, livestreamID, livestream.StartAt, livestream.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+	}
+	for _, count := range livecommentCounts {
+		points[count.Index].Livecomments = count.Count
+		points[count.Index].Tips = count.Tip
 	}
 
 	// リアクション数
-	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+	var reactionCounts []*timeseriesBucketCount
+	query = `
+	SELECT (created_at - ?) DIV ? AS idx, COUNT(*) AS count, 0 AS tip FROM reactions
+	WHERE livestream_id = ? AND created_at >= ? AND created_at < ?
+	GROUP BY idx
+	`
+	if err := tx.SelectContext(ctx, &reactionCounts, query, livestream.StartAt, bucket, livestreamID, livestream.StartAt, livestream.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	for _, count := range reactionCounts {
+		points[count.Index].Reactions = count.Count
 	}
 
-	// スパム報告数
-	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
+	// 同時視聴者数
+	// 各区間と視聴セッションが重なっている数を数える
+	var watchSessions []*WatchSessionModel
+	query = `
+	SELECT * FROM watch_sessions
+	WHERE livestream_id = ? AND started_at < ? AND (ended_at IS NULL OR ended_at >= ?)
+	`
+	if err := tx.SelectContext(ctx, &watchSessions, query, livestreamID, livestream.EndAt, livestream.StartAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch sessions: "+err.Error())
+	}
+	if len(points) > 0 {
+		diff := make([]int64, len(points)+1)
+		for _, watchSession := range watchSessions {
+			endedAt := watchSession.LastHeartbeatAt
+			if watchSession.EndedAt.Valid {
+				endedAt = watchSession.EndedAt.Int64
+			}
+			first := max(watchSession.StartedAt-livestream.StartAt, 0) / bucket
+			last := min(max(endedAt-livestream.StartAt, 0)/bucket, int64(len(points)-1))
+			diff[first]++
+			diff[last+1]--
+		}
+		var viewers int64
+		for i := range points {
+			viewers += diff[i]
+			points[i].Viewers = viewers
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+	return c.JSON(http.StatusOK, LivestreamTimeseries{
+		LivestreamID: livestreamID,
+		Bucket:       bucket,
+		StartAt:      livestream.StartAt,
+		EndAt:        livestream.EndAt,
+		Points:       points,
+	})
+}
+
+// 配信の視聴維持率API
+// 視聴者ごとの視聴時間の合計から、bucket秒ごとにその時間以上視聴した人数と割合を返す
+// GET /api/livestream/:livestream_id/statistics/retention
+func getLivestreamRetentionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	var bucket int64 = defaultTimeseriesBucketSeconds
+	if c.QueryParam("bucket") != "" {
+		bucket, err = strconv.ParseInt(c.QueryParam("bucket"), 10, 64)
+		if err != nil || bucket < minTimeseriesBucketSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket query parameter must be integer greater than or equal to %d", minTimeseriesBucketSeconds))
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestream LivestreamModel
+	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	numBuckets := (livestream.EndAt-livestream.StartAt+bucket-1)/bucket + 1
+	if numBuckets > maxTimeseriesBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket is too small for this livestream (at most %d buckets)", maxTimeseriesBuckets))
+	}
+
+	watchTimes, err := getViewerWatchTimes(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch times: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 視聴時間がi区間以上の人数を数える
+	counts := make([]int64, numBuckets)
+	for _, watchTime := range watchTimes {
+		counts[min(max(watchTime, 0)/bucket, numBuckets-1)]++
+	}
+	points := make([]LivestreamRetentionPoint, numBuckets)
+	var viewers int64
+	for i := numBuckets - 1; i >= 0; i-- {
+		viewers += counts[i]
+		points[i] = LivestreamRetentionPoint{
+			Elapsed: i * bucket,
+			Viewers: viewers,
+		}
+		if len(watchTimes) > 0 {
+			points[i].Ratio = float64(viewers) / float64(len(watchTimes))
+		}
+	}
+
+	return c.JSON(http.StatusOK, LivestreamRetention{
+		LivestreamID: livestreamID,
+		Bucket:       bucket,
+		Viewers:      int64(len(watchTimes)),
+		Points:       points,
 	})
 }
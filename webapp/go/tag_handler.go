@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type PostTagRequest struct {
+	Name     string   `json:"name"`
+	ParentID *int64   `json:"parent_id"`
+	Aliases  []string `json:"aliases"`
+}
+
+type PutTagRequest struct {
+	Name     string `json:"name"`
+	ParentID *int64 `json:"parent_id"`
+}
+
+type MergeTagRequest struct {
+	IntoTagID int64 `json:"into_tag_id"`
+}
+
+type PostTagAliasRequest struct {
+	Alias string `json:"alias"`
+}
+
+// タグ作成API (管理者向け)
+// POST /api/admin/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must not be empty")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := checkTagNameAvailable(ctx, tx, req.Name); err != nil {
+		return err
+	}
+	if req.ParentID != nil {
+		if _, err := getTagModel(ctx, tx, *req.ParentID); err != nil {
+			return err
+		}
+	}
+
+	tagModel := TagModel{
+		Name: req.Name,
+	}
+	if req.ParentID != nil {
+		tagModel.ParentID = sql.NullInt64{Int64: *req.ParentID, Valid: true}
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO tags (name, parent_id) VALUES (:name, :parent_id)", tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+	tagModel.ID = tagID
+
+	for _, alias := range req.Aliases {
+		if err := insertTagAlias(ctx, tx, tagID, alias); err != nil {
+			return err
+		}
+	}
+
+	tag, err := fillTagDetailResponse(ctx, tx, tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// タグ名・親タグ更新API (管理者向け)
+// PUT /api/admin/tag/:tag_id
+func putTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *PutTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must not be empty")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagModel(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+
+	if req.Name != tagModel.Name {
+		if err := checkTagNameAvailable(ctx, tx, req.Name); err != nil {
+			return err
+		}
+		tagModel.Name = req.Name
+	}
+
+	tagModel.ParentID = sql.NullInt64{}
+	if req.ParentID != nil {
+		if err := checkTagParent(ctx, tx, tagID, *req.ParentID); err != nil {
+			return err
+		}
+		tagModel.ParentID = sql.NullInt64{Int64: *req.ParentID, Valid: true}
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE tags SET name = :name, parent_id = :parent_id WHERE id = :id", tagModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	tag, err := fillTagDetailResponse(ctx, tx, *tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグ廃止API (管理者向け)
+// 既存の配信に付与されたタグはそのまま残し、一覧や新規予約からは除外する
+// DELETE /api/admin/tag/:tag_id
+func retireTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagModel(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+
+	if !tagModel.RetiredAt.Valid {
+		tagModel.RetiredAt = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE tags SET retired_at = :retired_at WHERE id = :id", tagModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to retire tag: "+err.Error())
+		}
+	}
+
+	tag, err := fillTagDetailResponse(ctx, tx, *tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグ統合API (管理者向け)
+// :tag_idのタグをinto_tag_idのタグに統合し、元のタグ名はエイリアスとして残す
+// POST /api/admin/tag/:tag_id/merge
+func mergeTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *MergeTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.IntoTagID == tagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	sourceTag, err := getTagModel(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	intoTag, err := getTagModel(ctx, tx, req.IntoTagID)
+	if err != nil {
+		return err
+	}
+	// 統合先が統合元の子孫だと、付け替え後に循環してしまう
+	if err := checkTagParent(ctx, tx, tagID, intoTag.ID); err != nil {
+		return err
+	}
+
+	// 統合先のタグが既に付いている配信は重複になるので、統合元の紐付けを消す
+	query := `
+	DELETE lt FROM livestream_tags lt
+	INNER JOIN livestream_tags dup ON dup.livestream_id = lt.livestream_id AND dup.tag_id = ?
+	WHERE lt.tag_id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete duplicated livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to move livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET parent_id = ? WHERE parent_id = ?", intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to move child tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to move tag aliases: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete merged tag: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, alias) VALUES (?, ?)", intoTag.ID, sourceTag.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+
+	tag, err := fillTagDetailResponse(ctx, tx, *intoTag)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグエイリアス追加API (管理者向け)
+// POST /api/admin/tag/:tag_id/alias
+func postTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *PostTagAliasRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagModel(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	if err := insertTagAlias(ctx, tx, tagID, req.Alias); err != nil {
+		return err
+	}
+
+	tag, err := fillTagDetailResponse(ctx, tx, *tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// タグエイリアス削除API (管理者向け)
+// DELETE /api/admin/tag/:tag_id/alias/:alias
+func deleteTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM tag_aliases WHERE tag_id = ? AND alias = ?", tagID, c.Param("alias"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag alias: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found tag alias")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getSearchTagIDs はタグ名またはエイリアスから、そのタグと子孫タグのIDを返す
+func getSearchTagIDs(ctx context.Context, tx *sqlx.Tx, name string) ([]int64, error) {
+	var tagID int64
+	err := tx.GetContext(ctx, &tagID, "SELECT id FROM tags WHERE name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.GetContext(ctx, &tagID, "SELECT tag_id FROM tag_aliases WHERE alias = ?", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 見つかったタグから一階層ずつ子タグを辿る
+	tagIDs := []int64{tagID}
+	for parentIDs := tagIDs; len(parentIDs) > 0; {
+		query, args, err := sqlx.In("SELECT id FROM tags WHERE parent_id IN (?)", parentIDs)
+		if err != nil {
+			return nil, err
+		}
+		var childIDs []int64
+		if err := tx.SelectContext(ctx, &childIDs, tx.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		tagIDs = append(tagIDs, childIDs...)
+		parentIDs = childIDs
+	}
+	return tagIDs, nil
+}
+
+func getTagModel(ctx context.Context, tx *sqlx.Tx, tagID int64) (*TagModel, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return &tagModel, nil
+}
+
+// checkTagNameAvailable はタグ名とエイリアスが同じ名前空間で重複しないことを確認する
+func checkTagNameAvailable(ctx context.Context, tx *sqlx.Tx, name string) error {
+	var count int64
+	query := "SELECT (SELECT COUNT(*) FROM tags WHERE name = ?) + (SELECT COUNT(*) FROM tag_aliases WHERE alias = ?)"
+	if err := tx.GetContext(ctx, &count, query, name, name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check tag name: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "tag name or alias already exists: "+name)
+	}
+	return nil
+}
+
+// checkTagParent は親タグを付け替えても階層が循環しないことを確認する
+func checkTagParent(ctx context.Context, tx *sqlx.Tx, tagID, parentID int64) error {
+	for id := parentID; ; {
+		if id == tagID {
+			return echo.NewHTTPError(http.StatusBadRequest, "tag hierarchy must not have a cycle")
+		}
+		parent, err := getTagModel(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if !parent.ParentID.Valid {
+			return nil
+		}
+		id = parent.ParentID.Int64
+	}
+}
+
+func insertTagAlias(ctx context.Context, tx *sqlx.Tx, tagID int64, alias string) error {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag alias must not be empty")
+	}
+	if err := checkTagNameAvailable(ctx, tx, alias); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, alias) VALUES (?, ?)", tagID, alias); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+	return nil
+}
+
+func fillTagDetailResponse(ctx context.Context, tx *sqlx.Tx, tagModel TagModel) (*TagDetail, error) {
+	var aliases []string
+	if err := tx.SelectContext(ctx, &aliases, "SELECT alias FROM tag_aliases WHERE tag_id = ? ORDER BY id", tagModel.ID); err != nil {
+		return nil, err
+	}
+
+	var usageCount int64
+	if err := tx.GetContext(ctx, &usageCount, "SELECT COUNT(*) FROM livestream_tags WHERE tag_id = ?", tagModel.ID); err != nil {
+		return nil, err
+	}
+
+	return buildTagDetail(tagModel, aliases, usageCount), nil
+}
+
+func buildTagDetail(tagModel TagModel, aliases []string, usageCount int64) *TagDetail {
+	tag := &TagDetail{
+		Tag: Tag{
+			ID:   tagModel.ID,
+			Name: tagModel.Name,
+		},
+		Aliases:    aliases,
+		UsageCount: usageCount,
+	}
+	if tagModel.ParentID.Valid {
+		parentID := tagModel.ParentID.Int64
+		tag.ParentID = &parentID
+	}
+	if tagModel.RetiredAt.Valid {
+		retiredAt := tagModel.RetiredAt.Int64
+		tag.RetiredAt = &retiredAt
+	}
+	return tag
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -14,14 +20,63 @@ type Tag struct {
 }
 
 type TagModel struct {
-	ID   int64  `db:"id"`
-	Name string `db:"name"`
+	ID        int64         `db:"id"`
+	Name      string        `db:"name"`
+	ParentID  sql.NullInt64 `db:"parent_id"`
+	RetiredAt sql.NullInt64 `db:"retired_at"`
+}
+
+type TagAliasModel struct {
+	ID    int64  `db:"id"`
+	TagID int64  `db:"tag_id"`
+	Alias string `db:"alias"`
+}
+
+// TagDetail はタグ一覧・管理APIで返す、階層やエイリアス、利用数を含むタグ
+type TagDetail struct {
+	Tag
+	ParentID   *int64   `json:"parent_id,omitempty"`
+	Aliases    []string `json:"aliases,omitempty"`
+	UsageCount int64    `json:"usage_count"`
+	RetiredAt  *int64   `json:"retired_at,omitempty"`
 }
 
 type TagsResponse struct {
-	Tags []*Tag `json:"tags"`
+	Tags []*TagDetail `json:"tags"`
+}
+
+type TagUsageCount struct {
+	TagID int64 `db:"tag_id"`
+	Count int64 `db:"cnt"`
+}
+
+type PutThemeRequest struct {
+	DarkMode           bool              `json:"dark_mode"`
+	AccentColor        string            `json:"accent_color"`
+	BackgroundImageUrl string            `json:"background_image_url"`
+	FontFamily         string            `json:"font_family"`
+	CSSVariables       map[string]string `json:"css_variables"`
 }
 
+const (
+	maxThemeCSSVariables      = 32
+	maxThemeCSSVariableLength = 128
+)
+
+var (
+	accentColorPattern     = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	cssVariableNamePattern = regexp.MustCompile(`^--[a-z0-9-]{1,62}$`)
+	// フロントエンドで読み込み済みのフォントのみ許可する
+	allowedThemeFonts = map[string]struct{}{
+		"sans-serif":        {},
+		"serif":             {},
+		"monospace":         {},
+		"Noto Sans JP":      {},
+		"Noto Serif JP":     {},
+		"M PLUS Rounded 1c": {},
+	}
+)
+
 func getTagHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -32,20 +87,35 @@ func getTagHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	var tagModels []*TagModel
-	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags WHERE retired_at IS NULL"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 
+	var aliasModels []*TagAliasModel
+	if err := tx.SelectContext(ctx, &aliasModels, "SELECT * FROM tag_aliases ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag aliases: "+err.Error())
+	}
+	aliasesByTagID := make(map[int64][]string)
+	for _, alias := range aliasModels {
+		aliasesByTagID[alias.TagID] = append(aliasesByTagID[alias.TagID], alias.Alias)
+	}
+
+	var usageCounts []*TagUsageCount
+	if err := tx.SelectContext(ctx, &usageCounts, "SELECT tag_id, COUNT(*) AS cnt FROM livestream_tags GROUP BY tag_id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tag usages: "+err.Error())
+	}
+	usageCountByTagID := make(map[int64]int64)
+	for _, usage := range usageCounts {
+		usageCountByTagID[usage.TagID] = usage.Count
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	tags := make([]*Tag, len(tagModels))
+	tags := make([]*TagDetail, len(tagModels))
 	for i := range tagModels {
-		tags[i] = &Tag{
-			ID:   tagModels[i].ID,
-			Name: tagModels[i].Name,
-		}
+		tags[i] = buildTagDetail(*tagModels[i], aliasesByTagID[tagModels[i].ID], usageCountByTagID[tagModels[i].ID])
 	}
 	return c.JSON(http.StatusOK, &TagsResponse{
 		Tags: tags,
@@ -89,10 +159,121 @@ func getStreamerThemeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	theme := Theme{
-		ID:       themeModel.ID,
-		DarkMode: themeModel.DarkMode,
+	return c.JSON(http.StatusOK, fillThemeResponse(themeModel))
+}
+
+// 配信者のテーマ更新API
+// PUT /api/user/me/theme
+func putMyThemeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	return c.JSON(http.StatusOK, theme)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PutThemeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateThemeRequest(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	cssVariables := req.CSSVariables
+	if cssVariables == nil {
+		cssVariables = map[string]string{}
+	}
+	encodedCSSVariables, err := json.Marshal(cssVariables)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode css variables: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	themeModel := ThemeModel{}
+	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found theme of the user in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+	}
+
+	themeModel.DarkMode = req.DarkMode
+	themeModel.AccentColor = strings.ToLower(req.AccentColor)
+	themeModel.BackgroundImageUrl = req.BackgroundImageUrl
+	themeModel.FontFamily = req.FontFamily
+	themeModel.CSSVariables = string(encodedCSSVariables)
+
+	query := "UPDATE themes SET dark_mode = :dark_mode, accent_color = :accent_color, background_image_url = :background_image_url, font_family = :font_family, css_variables = :css_variables WHERE id = :id"
+	if _, err := tx.NamedExecContext(ctx, query, themeModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillThemeResponse(themeModel))
+}
+
+func validateThemeRequest(req *PutThemeRequest) error {
+	if req.AccentColor != "" && !accentColorPattern.MatchString(req.AccentColor) {
+		return errors.New("accent_color must be a hex color like #1a2b3c")
+	}
+
+	if req.BackgroundImageUrl != "" {
+		if len(req.BackgroundImageUrl) > 255 {
+			return errors.New("background_image_url is too long")
+		}
+		u, err := url.Parse(req.BackgroundImageUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("background_image_url must be an absolute http(s) url")
+		}
+	}
+
+	if req.FontFamily != "" {
+		if _, ok := allowedThemeFonts[req.FontFamily]; !ok {
+			return fmt.Errorf("font_family %q is not supported", req.FontFamily)
+		}
+	}
+
+	if len(req.CSSVariables) > maxThemeCSSVariables {
+		return fmt.Errorf("css_variables must have at most %d entries", maxThemeCSSVariables)
+	}
+	for name, value := range req.CSSVariables {
+		if !cssVariableNamePattern.MatchString(name) {
+			return fmt.Errorf("css variable name %q must match --[a-z0-9-]+", name)
+		}
+		if len(value) > maxThemeCSSVariableLength || strings.ContainsAny(value, ";{}<>\\\"'") {
+			return fmt.Errorf("css variable %q has an invalid value", name)
+		}
+	}
+
+	return nil
+}
+
+func fillThemeResponse(themeModel ThemeModel) Theme {
+	theme := Theme{
+		ID:                 themeModel.ID,
+		DarkMode:           themeModel.DarkMode,
+		AccentColor:        themeModel.AccentColor,
+		BackgroundImageUrl: themeModel.BackgroundImageUrl,
+		FontFamily:         themeModel.FontFamily,
+	}
+	if themeModel.CSSVariables != "" {
+		// 保存時に検証済みなので、壊れたJSONは空として扱う
+		_ = json.Unmarshal([]byte(themeModel.CSSVariables), &theme.CSSVariables)
+	}
+	return theme
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 集計の粒度。ウィンドウの境界はこの単位で丸められる
+	trendingBucketSize        = 5 * time.Minute
+	defaultTrendingWindow     = "24h"
+	defaultTrendingLimit      = 10
+	maxTrendingLimit          = 100
+	trendingReactionPoints    = 1
+	trendingLivecommentPoints = 2
+	// チップはこの額ごとに1ポイント
+	trendingTipPerPoint = 100
+)
+
+type trendingWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+var trendingWindows = []trendingWindow{
+	{Name: "1h", Duration: time.Hour},
+	{Name: "24h", Duration: 24 * time.Hour},
+	{Name: "7d", Duration: 7 * 24 * time.Hour},
+}
+
+type TrendingTag struct {
+	Tag   Tag   `json:"tag"`
+	Score int64 `json:"score"`
+}
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	Score      int64      `json:"score"`
+}
+
+type TrendingResponse struct {
+	Window      string               `json:"window"`
+	Tags        []TrendingTag        `json:"tags"`
+	Livestreams []TrendingLivestream `json:"livestreams"`
+}
+
+type trendingBucket struct {
+	livestreams map[int64]int64
+	tags        map[int64]int64
+}
+
+type trendingEntry struct {
+	ID    int64
+	Score int64
+}
+
+// trendingIndex はリアクション・コメント・チップを時間ごとのバケットに記録し、
+// 各ウィンドウの合計を追加と期限切れのたびに差分で更新する
+type trendingIndex struct {
+	mu      sync.Mutex
+	buckets map[int64]*trendingBucket
+	// ウィンドウごとの配信・タグのスコア
+	livestreamScores []map[int64]int64
+	tagScores        []map[int64]int64
+	// ウィンドウごとに合計に含まれている最も古いバケットの開始時刻
+	windowStarts []int64
+}
+
+var trending = newTrendingIndex(time.Now())
+
+// replace は読み直した集計に置き換える
+func (idx *trendingIndex) replace(other *trendingIndex) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.buckets = other.buckets
+	idx.livestreamScores = other.livestreamScores
+	idx.tagScores = other.tagScores
+	idx.windowStarts = other.windowStarts
+}
+
+func newTrendingIndex(now time.Time) *trendingIndex {
+	idx := &trendingIndex{
+		buckets:          make(map[int64]*trendingBucket),
+		livestreamScores: make([]map[int64]int64, len(trendingWindows)),
+		tagScores:        make([]map[int64]int64, len(trendingWindows)),
+		windowStarts:     make([]int64, len(trendingWindows)),
+	}
+	for i, window := range trendingWindows {
+		idx.livestreamScores[i] = make(map[int64]int64)
+		idx.tagScores[i] = make(map[int64]int64)
+		idx.windowStarts[i] = trendingBucketStart(now.Add(-window.Duration))
+	}
+	return idx
+}
+
+func trendingBucketStart(t time.Time) int64 {
+	return t.Truncate(trendingBucketSize).Unix()
+}
+
+// record は配信への反応を記録する
+func (idx *trendingIndex) record(at time.Time, livestreamID int64, tagIDs []int64, points int64) {
+	if points <= 0 {
+		return
+	}
+	idx.apply(at, livestreamID, tagIDs, points)
+}
+
+// unrecord は記録済みの反応を取り消す。非表示にしたライブコメントの分を差し引くのに使う
+func (idx *trendingIndex) unrecord(at time.Time, livestreamID int64, tagIDs []int64, points int64) {
+	if points <= 0 {
+		return
+	}
+	idx.apply(at, livestreamID, tagIDs, -points)
+}
+
+func (idx *trendingIndex) apply(at time.Time, livestreamID int64, tagIDs []int64, points int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.advance(time.Now())
+
+	start := trendingBucketStart(at)
+	// 最も長いウィンドウより古いものは記録しない
+	if start < idx.windowStarts[len(trendingWindows)-1] {
+		return
+	}
+	bucket, ok := idx.buckets[start]
+	if !ok {
+		if points < 0 {
+			return
+		}
+		bucket = &trendingBucket{
+			livestreams: make(map[int64]int64),
+			tags:        make(map[int64]int64),
+		}
+		idx.buckets[start] = bucket
+	}
+	addTrendingScore(bucket.livestreams, livestreamID, points)
+	for _, tagID := range tagIDs {
+		addTrendingScore(bucket.tags, tagID, points)
+	}
+
+	for i := range trendingWindows {
+		if start < idx.windowStarts[i] {
+			continue
+		}
+		addTrendingScore(idx.livestreamScores[i], livestreamID, points)
+		for _, tagID := range tagIDs {
+			addTrendingScore(idx.tagScores[i], tagID, points)
+		}
+	}
+}
+
+func addTrendingScore(scores map[int64]int64, id int64, points int64) {
+	scores[id] += points
+	if scores[id] <= 0 {
+		delete(scores, id)
+	}
+}
+
+// advance はウィンドウから外れたバケットを合計から差し引く
+func (idx *trendingIndex) advance(now time.Time) {
+	for i, window := range trendingWindows {
+		newStart := trendingBucketStart(now.Add(-window.Duration))
+		if newStart <= idx.windowStarts[i] {
+			continue
+		}
+		for start, bucket := range idx.buckets {
+			if start < idx.windowStarts[i] || start >= newStart {
+				continue
+			}
+			subtractTrendingScores(idx.livestreamScores[i], bucket.livestreams)
+			subtractTrendingScores(idx.tagScores[i], bucket.tags)
+		}
+		idx.windowStarts[i] = newStart
+	}
+
+	// 最も長いウィンドウからも外れたバケットは捨てる
+	oldest := idx.windowStarts[len(trendingWindows)-1]
+	for start := range idx.buckets {
+		if start < oldest {
+			delete(idx.buckets, start)
+		}
+	}
+}
+
+func subtractTrendingScores(scores, expired map[int64]int64) {
+	for id, points := range expired {
+		scores[id] -= points
+		if scores[id] <= 0 {
+			delete(scores, id)
+		}
+	}
+}
+
+// ranked はウィンドウ内の配信とタグをスコアの高い順に返す
+// 廃止されたタグや取り消された配信も含むので、呼び出し元で除いてから件数を絞る
+func (idx *trendingIndex) ranked(windowIndex int) (livestreams []trendingEntry, tags []trendingEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.advance(time.Now())
+
+	return rankTrendingEntries(idx.livestreamScores[windowIndex]), rankTrendingEntries(idx.tagScores[windowIndex])
+}
+
+func rankTrendingEntries(scores map[int64]int64) []trendingEntry {
+	entries := make([]trendingEntry, 0, len(scores))
+	for id, score := range scores {
+		entries = append(entries, trendingEntry{ID: id, Score: score})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	return entries
+}
+
+// livecommentTrendingPoints はコメントとチップをポイントに換算する
+func livecommentTrendingPoints(tip int64) int64 {
+	return trendingLivecommentPoints + tip/trendingTipPerPoint
+}
+
+func tagIDsOf(tags []Tag) []int64 {
+	tagIDs := make([]int64, len(tags))
+	for i := range tags {
+		tagIDs[i] = tags[i].ID
+	}
+	return tagIDs
+}
+
+// loadTrendingIndex は最も長いウィンドウ分のリアクションとコメントをDBから読み直す
+func loadTrendingIndex(ctx context.Context) error {
+	now := time.Now()
+	idx := newTrendingIndex(now)
+	since := idx.windowStarts[len(trendingWindows)-1]
+
+	type trendingEvent struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Tip          int64 `db:"tip"`
+		CreatedAt    int64 `db:"created_at"`
+	}
+	var reactions []*trendingEvent
+	if err := dbConn.SelectContext(ctx, &reactions, "SELECT livestream_id, 0 AS tip, created_at FROM reactions WHERE created_at >= ?", since); err != nil {
+		return fmt.Errorf("failed to get reactions: %w", err)
+	}
+	var livecomments []*trendingEvent
+	if err := dbConn.SelectContext(ctx, &livecomments, "SELECT livestream_id, tip, created_at FROM livecomments WHERE created_at >= ? AND hidden_at IS NULL", since); err != nil {
+		return fmt.Errorf("failed to get livecomments: %w", err)
+	}
+
+	livestreamIDSet := make(map[int64]struct{})
+	for _, event := range append(reactions, livecomments...) {
+		livestreamIDSet[event.LivestreamID] = struct{}{}
+	}
+	tagIDsByLivestreamID := make(map[int64][]int64)
+	if len(livestreamIDSet) > 0 {
+		livestreamIDs := make([]int64, 0, len(livestreamIDSet))
+		for livestreamID := range livestreamIDSet {
+			livestreamIDs = append(livestreamIDs, livestreamID)
+		}
+		query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
+		if err != nil {
+			return fmt.Errorf("failed to construct IN query: %w", err)
+		}
+		var livestreamTags []*LivestreamTagModel
+		if err := dbConn.SelectContext(ctx, &livestreamTags, dbConn.Rebind(query), args...); err != nil {
+			return fmt.Errorf("failed to get livestream tags: %w", err)
+		}
+		for _, livestreamTag := range livestreamTags {
+			tagIDsByLivestreamID[livestreamTag.LivestreamID] = append(tagIDsByLivestreamID[livestreamTag.LivestreamID], livestreamTag.TagID)
+		}
+	}
+
+	for _, reaction := range reactions {
+		idx.record(time.Unix(reaction.CreatedAt, 0), reaction.LivestreamID, tagIDsByLivestreamID[reaction.LivestreamID], trendingReactionPoints)
+	}
+	for _, livecomment := range livecomments {
+		idx.record(time.Unix(livecomment.CreatedAt, 0), livecomment.LivestreamID, tagIDsByLivestreamID[livecomment.LivestreamID], livecommentTrendingPoints(livecomment.Tip))
+	}
+
+	trending.replace(idx)
+	return nil
+}
+
+// トレンドのタグと配信API
+// GET /api/trending
+func getTrendingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	windowName := defaultTrendingWindow
+	if c.QueryParam("window") != "" {
+		windowName = c.QueryParam("window")
+	}
+	windowIndex := -1
+	for i, window := range trendingWindows {
+		if window.Name == windowName {
+			windowIndex = i
+			break
+		}
+	}
+	if windowIndex < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "window query parameter must be one of 1h, 24h, 7d")
+	}
+
+	limit := defaultTrendingLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > maxTrendingLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer between 1 and 100")
+		}
+	}
+
+	livestreamEntries, tagEntries := trending.ranked(windowIndex)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 廃止されたタグを除いてlimit件になるまで、上位からlimit件ずつ取得する
+	trendingTags := []TrendingTag{}
+	for i := 0; i < len(tagEntries) && len(trendingTags) < limit; i += limit {
+		entries := tagEntries[i:min(i+limit, len(tagEntries))]
+		tagIDs := make([]int64, len(entries))
+		for j := range entries {
+			tagIDs[j] = entries[j].ID
+		}
+		query, args, err := sqlx.In("SELECT id, name FROM tags WHERE id IN (?) AND retired_at IS NULL", tagIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for tags: "+err.Error())
+		}
+		var tags []*Tag
+		if err := tx.SelectContext(ctx, &tags, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+		tagsByID := make(map[int64]*Tag, len(tags))
+		for _, tag := range tags {
+			tagsByID[tag.ID] = tag
+		}
+		for _, entry := range entries {
+			if tag, ok := tagsByID[entry.ID]; ok && len(trendingTags) < limit {
+				trendingTags = append(trendingTags, TrendingTag{Tag: *tag, Score: entry.Score})
+			}
+		}
+	}
+
+	// 取り消された配信も同様に除く
+	trendingLivestreams := []TrendingLivestream{}
+	for i := 0; i < len(livestreamEntries) && len(trendingLivestreams) < limit; i += limit {
+		entries := livestreamEntries[i:min(i+limit, len(livestreamEntries))]
+		livestreamIDs := make([]int64, len(entries))
+		for j := range entries {
+			livestreamIDs[j] = entries[j].ID
+		}
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) AND status != ?", livestreamIDs, livestreamStatusCancelled)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for livestreams: "+err.Error())
+		}
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		livestreamsByID := make(map[int64]Livestream, len(livestreams))
+		for _, livestream := range livestreams {
+			livestreamsByID[livestream.ID] = livestream
+		}
+		for _, entry := range entries {
+			if livestream, ok := livestreamsByID[entry.ID]; ok && len(trendingLivestreams) < limit {
+				trendingLivestreams = append(trendingLivestreams, TrendingLivestream{Livestream: livestream, Score: entry.Score})
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &TrendingResponse{
+		Window:      windowName,
+		Tags:        trendingTags,
+		Livestreams: trendingLivestreams,
+	})
+}
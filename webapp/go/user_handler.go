@@ -36,6 +36,8 @@ type UserModel struct {
 	HashedPassword string `db:"password"`
 	Tip            int64  `db:"tip"`
 	ReactionsCount int64  `db:"reactions_count"`
+	FollowersCount int64  `db:"followers_count"`
+	FollowingCount int64  `db:"following_count"`
 }
 
 type User struct {
@@ -45,17 +47,29 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォロワー数とフォロー数
+	FollowersCount int64 `json:"followers_count"`
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
-	ID       int64 `json:"id"`
-	DarkMode bool  `json:"dark_mode"`
+	ID                 int64             `json:"id"`
+	DarkMode           bool              `json:"dark_mode"`
+	AccentColor        string            `json:"accent_color,omitempty"`
+	BackgroundImageUrl string            `json:"background_image_url,omitempty"`
+	FontFamily         string            `json:"font_family,omitempty"`
+	CSSVariables       map[string]string `json:"css_variables,omitempty"`
 }
 
 type ThemeModel struct {
-	ID       int64 `db:"id"`
-	UserID   int64 `db:"user_id"`
-	DarkMode bool  `db:"dark_mode"`
+	ID                 int64  `db:"id"`
+	UserID             int64  `db:"user_id"`
+	DarkMode           bool   `db:"dark_mode"`
+	AccentColor        string `db:"accent_color"`
+	BackgroundImageUrl string `db:"background_image_url"`
+	FontFamily         string `db:"font_family"`
+	// JSONオブジェクトとして保存されたCSSカスタムプロパティ
+	CSSVariables string `db:"css_variables"`
 }
 
 type PostUserRequest struct {
@@ -274,6 +288,8 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	userRankingIndex.set(userModel.ID, UserRankingEntry{Username: userModel.Name})
+
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -403,6 +419,22 @@ func verifyUserSession(c echo.Context) error {
 	return nil
 }
 
+// verifyAdminSession はセッションを検証した上で、管理者として登録されたユーザであるかを確認する
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	if _, ok := adminUsernames[username]; !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "only administrators can use this API")
+	}
+
+	return nil
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
@@ -420,15 +452,14 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 	}
 
 	user := User{
-		ID:          userModel.ID,
-		Name:        userModel.Name,
-		DisplayName: userModel.DisplayName,
-		Description: userModel.Description,
-		Theme: Theme{
-			ID:       themeModel.ID,
-			DarkMode: themeModel.DarkMode,
-		},
-		IconHash: iconHash,
+		ID:             userModel.ID,
+		Name:           userModel.Name,
+		DisplayName:    userModel.DisplayName,
+		Description:    userModel.Description,
+		Theme:          fillThemeResponse(themeModel),
+		IconHash:       iconHash,
+		FollowersCount: userModel.FollowersCount,
+		FollowingCount: userModel.FollowingCount,
 	}
 
 	return user, nil
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// クライアントがハートビートを送る間隔
+	watchSessionHeartbeatInterval = 10 * time.Second
+	// 最後のハートビートからこの時間が経つと退出したものとみなす
+	watchSessionTimeout = 30 * time.Second
+)
+
+type WatchSessionModel struct {
+	ID              int64 `db:"id"`
+	UserID          int64 `db:"user_id"`
+	LivestreamID    int64 `db:"livestream_id"`
+	StartedAt       int64 `db:"started_at"`
+	LastHeartbeatAt int64 `db:"last_heartbeat_at"`
+	// 退出またはハートビートが途絶えた場合に設定される
+	EndedAt sql.NullInt64 `db:"ended_at"`
+}
+
+type HeartbeatResponse struct {
+	SessionID int64 `json:"session_id"`
+	// 次のハートビートまでの秒数
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+	ExpiresAt         int64 `json:"expires_at"`
+	CurrentViewers    int64 `json:"current_viewers"`
+}
+
+type LivestreamViewers struct {
+	CurrentViewers int64 `json:"current_viewers"`
+	PeakViewers    int64 `json:"peak_viewers"`
+}
+
+// 視聴継続API
+// 視聴中のクライアントはwatchSessionHeartbeatIntervalごとに呼ぶ
+// POST /api/livestream/:livestream_id/heartbeat
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	now := time.Now()
+	if err := checkLivestreamOpen(livestreamModel, now.Unix()); err != nil {
+		return err
+	}
+
+	watchSession, err := touchWatchSession(ctx, tx, userID, livestreamID, now)
+	if err != nil {
+		return err
+	}
+	currentViewers, err := updateLivestreamViewers(ctx, tx, livestreamID, now)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &HeartbeatResponse{
+		SessionID:         watchSession.ID,
+		HeartbeatInterval: int64(watchSessionHeartbeatInterval / time.Second),
+		ExpiresAt:         now.Add(watchSessionTimeout).Unix(),
+		CurrentViewers:    currentViewers,
+	})
+}
+
+// 同時視聴者数API
+// GET /api/livestream/:livestream_id/viewers
+func getLivestreamViewersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	currentViewers, err := countCurrentViewers(ctx, tx, livestreamID, time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count current viewers: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &LivestreamViewers{
+		CurrentViewers: currentViewers,
+		PeakViewers:    livestreamModel.PeakViewers,
+	})
+}
+
+// touchWatchSession は視聴中のセッションを延長する。途切れていれば新しく始める
+func touchWatchSession(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64, now time.Time) (*WatchSessionModel, error) {
+	// ハートビートが途絶えたセッションは最後のハートビートで終了したものとする
+	if _, err := tx.ExecContext(ctx, "UPDATE watch_sessions SET ended_at = last_heartbeat_at WHERE livestream_id = ? AND ended_at IS NULL AND last_heartbeat_at < ?", livestreamID, now.Add(-watchSessionTimeout).Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to expire watch sessions: "+err.Error())
+	}
+
+	var watchSession WatchSessionModel
+	err := tx.GetContext(ctx, &watchSession, "SELECT * FROM watch_sessions WHERE user_id = ? AND livestream_id = ? AND ended_at IS NULL FOR UPDATE", userID, livestreamID)
+	if err == nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE watch_sessions SET last_heartbeat_at = ? WHERE id = ?", now.Unix(), watchSession.ID); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update watch session: "+err.Error())
+		}
+		watchSession.LastHeartbeatAt = now.Unix()
+		return &watchSession, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch session: "+err.Error())
+	}
+
+	watchSession = WatchSessionModel{
+		UserID:          userID,
+		LivestreamID:    livestreamID,
+		StartedAt:       now.Unix(),
+		LastHeartbeatAt: now.Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO watch_sessions (user_id, livestream_id, started_at, last_heartbeat_at) VALUES (:user_id, :livestream_id, :started_at, :last_heartbeat_at)", watchSession)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch session: "+err.Error())
+	}
+	watchSessionID, err := rs.LastInsertId()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted watch session id: "+err.Error())
+	}
+	watchSession.ID = watchSessionID
+
+	return &watchSession, nil
+}
+
+// endWatchSession は視聴中のセッションを終了する。セッションは履歴として残す
+func endWatchSession(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64, now time.Time) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE watch_sessions SET ended_at = ? WHERE user_id = ? AND livestream_id = ? AND ended_at IS NULL", now.Unix(), userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to end watch session: "+err.Error())
+	}
+	return nil
+}
+
+// updateLivestreamViewers は現在の同時視聴者数を求め、最大同時視聴者数を更新する
+func updateLivestreamViewers(ctx context.Context, tx *sqlx.Tx, livestreamID int64, now time.Time) (int64, error) {
+	currentViewers, err := countCurrentViewers(ctx, tx, livestreamID, now)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count current viewers: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET peak_viewers = GREATEST(peak_viewers, ?) WHERE id = ?", currentViewers, livestreamID); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to update peak viewers: "+err.Error())
+	}
+	return currentViewers, nil
+}
+
+func countCurrentViewers(ctx context.Context, tx *sqlx.Tx, livestreamID int64, now time.Time) (int64, error) {
+	var currentViewers int64
+	if err := tx.GetContext(ctx, &currentViewers, "SELECT COUNT(DISTINCT user_id) FROM watch_sessions WHERE livestream_id = ? AND ended_at IS NULL AND last_heartbeat_at >= ?", livestreamID, now.Add(-watchSessionTimeout).Unix()); err != nil {
+		return 0, err
+	}
+	return currentViewers, nil
+}
+
+// watchTimeSummary は視聴セッションから求めた視聴時間 (秒)
+type watchTimeSummary struct {
+	TotalWatchTime int64 `db:"total_watch_time"`
+	// 配信ごとの視聴者数の合計
+	Viewers int64 `db:"viewers"`
+}
+
+func (s watchTimeSummary) averageWatchTime() int64 {
+	if s.Viewers == 0 {
+		return 0
+	}
+	return s.TotalWatchTime / s.Viewers
+}
+
+// 視聴中のセッションは最後のハートビートまでを視聴時間とする
+const watchSessionDurationExpr = "COALESCE(ws.ended_at, ws.last_heartbeat_at) - ws.started_at"
+
+func getLivestreamWatchTime(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (watchTimeSummary, error) {
+	var summary watchTimeSummary
+	query := "SELECT IFNULL(SUM(" + watchSessionDurationExpr + "), 0) AS total_watch_time, COUNT(DISTINCT ws.user_id) AS viewers FROM watch_sessions ws WHERE ws.livestream_id = ?"
+	if err := tx.GetContext(ctx, &summary, query, livestreamID); err != nil {
+		return watchTimeSummary{}, err
+	}
+	return summary, nil
+}
+
+func getUserWatchTime(ctx context.Context, tx *sqlx.Tx, userID int64) (watchTimeSummary, error) {
+	var summary watchTimeSummary
+	query := `
+	SELECT IFNULL(SUM(` + watchSessionDurationExpr + `), 0) AS total_watch_time, COUNT(DISTINCT ws.livestream_id, ws.user_id) AS viewers
+	FROM watch_sessions ws
+	INNER JOIN livestreams l ON l.id = ws.livestream_id
+	WHERE l.user_id = ?
+	`
+	if err := tx.GetContext(ctx, &summary, query, userID); err != nil {
+		return watchTimeSummary{}, err
+	}
+	return summary, nil
+}
+
+// getViewerWatchTimes は配信の視聴者ごとの視聴時間の合計を返す
+func getViewerWatchTimes(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]int64, error) {
+	var watchTimes []int64
+	query := "SELECT SUM(" + watchSessionDurationExpr + ") AS watch_time FROM watch_sessions ws WHERE ws.livestream_id = ? GROUP BY ws.user_id"
+	if err := tx.SelectContext(ctx, &watchTimes, query, livestreamID); err != nil {
+		return nil, err
+	}
+	return watchTimes, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// キャンセル待ちの状態
+const (
+	waitlistStatusWaiting   = "waiting"
+	waitlistStatusBooked    = "booked"
+	waitlistStatusWithdrawn = "withdrawn"
+)
+
+type ReservationWaitlistModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	Description  string `db:"description"`
+	PlaylistUrl  string `db:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url"`
+	// 付与するタグIDのJSON配列
+	Tags         string        `db:"tags"`
+	StartAt      int64         `db:"start_at"`
+	EndAt        int64         `db:"end_at"`
+	Status       string        `db:"status"`
+	LivestreamID sql.NullInt64 `db:"livestream_id"`
+	CreatedAt    int64         `db:"created_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID           int64  `json:"id"`
+	Title        string `json:"title"`
+	StartAt      int64  `json:"start_at"`
+	EndAt        int64  `json:"end_at"`
+	Status       string `json:"status"`
+	LivestreamID *int64 `json:"livestream_id,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// キャンセル待ち登録API
+// 予約枠に空きがあればその場で予約される
+// POST /api/livestream/reservation/waitlist
+func joinReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Recurrence != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "recurring reservations can't join the waitlist")
+	}
+	if err := validateReservationRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagIDs, err := normalizeLivestreamTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return err
+	}
+	encodedTagIDs, err := json.Marshal(tagIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode tags: "+err.Error())
+	}
+
+	waitlistModel := ReservationWaitlistModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		Tags:         string(encodedTagIDs),
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		Status:       waitlistStatusWaiting,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, start_at, end_at, status, created_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :start_at, :end_at, :status, :created_at)", waitlistModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation waitlist: "+err.Error())
+	}
+	waitlistID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation waitlist id: "+err.Error())
+	}
+
+	bookedLivestreamModels, err := processReservationWaitlist(ctx, tx, req.StartAt, req.EndAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.GetContext(ctx, &waitlistModel, "SELECT * FROM reservation_waitlist WHERE id = ?", waitlistID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addLivestreamsToRanking(bookedLivestreamModels)
+
+	return c.JSON(http.StatusCreated, fillReservationWaitlistResponse(waitlistModel))
+}
+
+// 自分のキャンセル待ち一覧API
+// GET /api/livestream/reservation/waitlist
+func getReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var waitlistModels []*ReservationWaitlistModel
+	if err := dbConn.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	entries := make([]ReservationWaitlistEntry, len(waitlistModels))
+	for i := range waitlistModels {
+		entries[i] = fillReservationWaitlistResponse(*waitlistModels[i])
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// キャンセル待ち取り下げAPI
+// DELETE /api/livestream/reservation/waitlist/:waitlist_id
+func withdrawReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	waitlistID, err := strconv.ParseInt(c.Param("waitlist_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "waitlist_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var waitlistModel ReservationWaitlistModel
+	if err := tx.GetContext(ctx, &waitlistModel, "SELECT * FROM reservation_waitlist WHERE id = ? AND user_id = ? FOR UPDATE", waitlistID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found reservation waitlist that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+	if waitlistModel.Status != waitlistStatusWaiting {
+		return echo.NewHTTPError(http.StatusConflict, "reservation waitlist is already "+waitlistModel.Status)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ? WHERE id = ?", waitlistStatusWithdrawn, waitlistID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation waitlist: "+err.Error())
+	}
+	waitlistModel.Status = waitlistStatusWithdrawn
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillReservationWaitlistResponse(waitlistModel))
+}
+
+// processReservationWaitlist は指定区間に重なるキャンセル待ちを登録順に見て、
+// 予約枠に空きがあるものを予約し、作成した配信を返す
+func processReservationWaitlist(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) ([]*LivestreamModel, error) {
+	var waitlistModels []*ReservationWaitlistModel
+	// 既に開始時刻を過ぎたものは予約しない
+	query := "SELECT * FROM reservation_waitlist WHERE status = ? AND start_at < ? AND end_at > ? AND start_at > ? ORDER BY created_at, id FOR UPDATE"
+	if err := tx.SelectContext(ctx, &waitlistModels, query, waitlistStatusWaiting, endAt, startAt, time.Now().Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	var bookedLivestreamModels []*LivestreamModel
+	for _, waitlistModel := range waitlistModels {
+		if err := consumeReservationSlots(ctx, tx, waitlistModel.StartAt, waitlistModel.EndAt); err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) && he.Code == http.StatusBadRequest {
+				// まだ空きがないので待ち続ける
+				continue
+			}
+			return nil, err
+		}
+
+		var tagIDs []int64
+		if err := json.Unmarshal([]byte(waitlistModel.Tags), &tagIDs); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to decode waitlist tags: "+err.Error())
+		}
+		// キャンセル待ちの登録後に廃止・統合されたタグは付けない
+		tagIDs, err := filterActiveTagIDs(ctx, tx, tagIDs)
+		if err != nil {
+			return nil, err
+		}
+		livestreamModel := &LivestreamModel{
+			UserID:       waitlistModel.UserID,
+			Title:        waitlistModel.Title,
+			Description:  waitlistModel.Description,
+			PlaylistUrl:  waitlistModel.PlaylistUrl,
+			ThumbnailUrl: waitlistModel.ThumbnailUrl,
+			StartAt:      waitlistModel.StartAt,
+			EndAt:        waitlistModel.EndAt,
+			Status:       livestreamStatusScheduled,
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ? WHERE id = ?", waitlistStatusBooked, livestreamModel.ID, waitlistModel.ID); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation waitlist: "+err.Error())
+		}
+
+		if err := notifyWaitlistBooked(ctx, tx, *livestreamModel); err != nil {
+			return nil, err
+		}
+		bookedLivestreamModels = append(bookedLivestreamModels, livestreamModel)
+	}
+
+	return bookedLivestreamModels, nil
+}
+
+// notifyWaitlistBooked はキャンセル待ちから予約された配信について通知する
+// キャンセル待ちしていた配信者には予約されたことを、フォロワーには通常の予約と同じく配信予定を通知する
+func notifyWaitlistBooked(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) error {
+	if err := insertNotification(ctx, tx, &NotificationModel{
+		UserID:       livestreamModel.UserID,
+		Type:         notificationTypeWaitlistBooked,
+		LivestreamID: sql.NullInt64{Int64: livestreamModel.ID, Valid: true},
+	}); err != nil {
+		return err
+	}
+	return notifyFollowers(ctx, tx, notificationTypeLivestreamReserved, livestreamModel)
+}
+
+func fillReservationWaitlistResponse(waitlistModel ReservationWaitlistModel) ReservationWaitlistEntry {
+	return ReservationWaitlistEntry{
+		ID:           waitlistModel.ID,
+		Title:        waitlistModel.Title,
+		StartAt:      waitlistModel.StartAt,
+		EndAt:        waitlistModel.EndAt,
+		Status:       waitlistModel.Status,
+		LivestreamID: nullInt64Pointer(waitlistModel.LivestreamID),
+		CreatedAt:    waitlistModel.CreatedAt,
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// Webhookで通知するイベント
+const (
+	webhookEventLivecomment = "livecomment"
+	webhookEventTip         = "tip"
+	webhookEventReaction    = "reaction"
+	webhookEventReport      = "report"
+)
+
+var webhookEvents = map[string]struct{}{
+	webhookEventLivecomment: {},
+	webhookEventTip:         {},
+	webhookEventReaction:    {},
+	webhookEventReport:      {},
+}
+
+// 配送の状態
+const (
+	webhookDeliveryStatusPending   = "pending"
+	webhookDeliveryStatusSucceeded = "succeeded"
+	webhookDeliveryStatusFailed    = "failed"
+)
+
+const (
+	webhookSignatureHeader = "X-Isupipe-Signature"
+	webhookEventHeader     = "X-Isupipe-Event"
+	webhookDeliveryHeader  = "X-Isupipe-Delivery"
+	// 配送の試行回数の上限
+	webhookMaxAttempts = 5
+	// 再送間隔の基準 (試行ごとに倍にする)
+	webhookRetryBaseInterval = 10 * time.Second
+	webhookPollInterval      = time.Second
+	webhookDeliveryBatchSize = 20
+	webhookRequestTimeout    = 5 * time.Second
+	// 配送中の行を他のワーカーが拾わないようにする期間
+	// 取得した行は順に送信するので、全てタイムアウトしても期限が切れないようにする
+	webhookDeliveryLease    = webhookDeliveryBatchSize*webhookRequestTimeout + time.Minute
+	webhookMaxErrorLength   = 255
+	defaultWebhookLogsLimit = 50
+)
+
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// webhookClient は内部ネットワークに接続しない
+// 名前解決後のアドレスを接続時に確認するので、リダイレクトやDNSの書き換えでも回避できない
+var webhookClient = &http.Client{
+	Timeout: webhookRequestTimeout,
+	Transport: &http.Transport{
+		// プロキシ経由だと接続先のアドレスを確認できない
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: webhookRequestTimeout,
+			Control: checkWebhookDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookRequestTimeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+func checkWebhookDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isWebhookAddressAllowed(addr) {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, addr)
+	}
+	return nil
+}
+
+// isWebhookAddressAllowed はループバック、プライベート、リンクローカル、未指定のアドレスを拒否する
+func isWebhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !(addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified())
+}
+
+type WebhookModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	Url    string `db:"url"`
+	Secret string `db:"secret"`
+	// 購読するイベントのカンマ区切り
+	Events    string `db:"events"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type Webhook struct {
+	ID     int64    `json:"id"`
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	// 登録時のみ返す
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PostWebhookRequest struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type WebhookDeliveryModel struct {
+	ID             int64          `db:"id"`
+	WebhookID      int64          `db:"webhook_id"`
+	Event          string         `db:"event"`
+	Payload        string         `db:"payload"`
+	Status         string         `db:"status"`
+	Attempts       int64          `db:"attempts"`
+	NextAttemptAt  int64          `db:"next_attempt_at"`
+	ResponseStatus sql.NullInt64  `db:"response_status"`
+	LastError      sql.NullString `db:"last_error"`
+	CreatedAt      int64          `db:"created_at"`
+	DeliveredAt    sql.NullInt64  `db:"delivered_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64  `json:"id"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	Attempts       int64  `json:"attempts"`
+	NextAttemptAt  *int64 `json:"next_attempt_at,omitempty"`
+	ResponseStatus *int64 `json:"response_status,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	DeliveredAt    *int64 `json:"delivered_at,omitempty"`
+}
+
+// WebhookPayload はWebhookで送信するリクエストボディ
+// dataにはAPIレスポンスと同じ形のLivecomment, Reaction, LivecommentReportが入る
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Webhook登録API
+// POST /api/webhook
+func postWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostWebhookRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must be an absolute http or https url")
+	}
+	// ホスト名の場合は送信時に名前解決したアドレスを確認する
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !isWebhookAddressAllowed(addr) {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must not point to a loopback, private or link-local address")
+	}
+	events, err := normalizeWebhookEvents(req.Events)
+	if err != nil {
+		return err
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate webhook secret: "+err.Error())
+	}
+
+	webhookModel := WebhookModel{
+		UserID:    userID,
+		Url:       req.Url,
+		Secret:    hex.EncodeToString(secretBytes),
+		Events:    strings.Join(events, ","),
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES (:user_id, :url, :secret, :events, :created_at)", webhookModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook: "+err.Error())
+	}
+	webhookID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook id: "+err.Error())
+	}
+	webhookModel.ID = webhookID
+
+	webhook := fillWebhookResponse(webhookModel)
+	// 署名の検証に必要なので登録時だけシークレットを返す
+	webhook.Secret = webhookModel.Secret
+
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+// 自分のWebhook一覧API
+// GET /api/webhook
+func getWebhooksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var webhookModels []*WebhookModel
+	if err := dbConn.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+
+	webhooks := make([]Webhook, len(webhookModels))
+	for i := range webhookModels {
+		webhooks[i] = fillWebhookResponse(*webhookModels[i])
+	}
+
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// Webhook削除API
+// 未配送のものは配送しない
+// DELETE /api/webhook/:webhook_id
+func deleteWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getWebhookModel(ctx, tx, webhookID, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", webhookID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook deliveries: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", webhookID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Webhook配送ログAPI
+// GET /api/webhook/:webhook_id/delivery
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	limit := defaultWebhookLogsLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getWebhookModel(ctx, tx, webhookID, userID); err != nil {
+		return err
+	}
+
+	var deliveryModels []*WebhookDeliveryModel
+	query := fmt.Sprintf("SELECT * FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT %d", limit)
+	if err := tx.SelectContext(ctx, &deliveryModels, query, webhookID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook deliveries: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	deliveries := make([]WebhookDelivery, len(deliveryModels))
+	for i := range deliveryModels {
+		deliveries[i] = fillWebhookDeliveryResponse(*deliveryModels[i])
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// getWebhookModel は自分が登録したWebhookを取得する
+func getWebhookModel(ctx context.Context, tx *sqlx.Tx, webhookID, userID int64) (*WebhookModel, error) {
+	var webhookModel WebhookModel
+	if err := tx.GetContext(ctx, &webhookModel, "SELECT * FROM webhooks WHERE id = ? AND user_id = ? FOR UPDATE", webhookID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found webhook that has the given id")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook: "+err.Error())
+	}
+	return &webhookModel, nil
+}
+
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(events))
+	normalized := make([]string, 0, len(events))
+	for _, event := range events {
+		if _, ok := webhookEvents[event]; !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "unknown webhook event: "+event)
+		}
+		if _, ok := seen[event]; ok {
+			continue
+		}
+		seen[event] = struct{}{}
+		normalized = append(normalized, event)
+	}
+	if len(normalized) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "events must not be empty")
+	}
+	return normalized, nil
+}
+
+// enqueueWebhookEvent は配信者のWebhookのうちイベントを購読しているものへの配送を登録する
+// 実際の送信はコミット後にrunWebhookDeliveryWorkerが行う
+func enqueueWebhookEvent(ctx context.Context, tx *sqlx.Tx, userID int64, event string, data interface{}) error {
+	var webhookModels []*WebhookModel
+	if err := tx.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ? AND FIND_IN_SET(?, events) > 0", userID, event); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+	if len(webhookModels) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	payload, err := json.Marshal(&WebhookPayload{
+		Event:     event,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode webhook payload: "+err.Error())
+	}
+
+	for _, webhookModel := range webhookModels {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at) VALUES (:webhook_id, :event, :payload, :status, :attempts, :next_attempt_at, :created_at)", &WebhookDeliveryModel{
+			WebhookID:     webhookModel.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        webhookDeliveryStatusPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook delivery: "+err.Error())
+		}
+	}
+
+	return nil
+}
+
+// runWebhookDeliveryWorker は配送待ちのWebhookを定期的に送信する
+func runWebhookDeliveryWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := deliverPendingWebhooks(ctx); err != nil {
+			log.Printf("failed to deliver webhooks: %+v", err)
+		}
+	}
+}
+
+type webhookDeliveryJob struct {
+	WebhookDeliveryModel
+	Url    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+func deliverPendingWebhooks(ctx context.Context) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 複数のサーバーで動いていても同じ配送を重複して送らないようにする
+	now := time.Now()
+	var jobs []*webhookDeliveryJob
+	query := `
+	SELECT d.*, w.url, w.secret FROM webhook_deliveries d
+	INNER JOIN webhooks w ON w.id = d.webhook_id
+	WHERE d.status = ? AND d.next_attempt_at <= ?
+	ORDER BY d.next_attempt_at, d.id
+	LIMIT ?
+	FOR UPDATE SKIP LOCKED
+	`
+	if err := tx.SelectContext(ctx, &jobs, query, webhookDeliveryStatusPending, now.Unix(), webhookDeliveryBatchSize); err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(jobs))
+	for i := range jobs {
+		ids[i] = jobs[i].ID
+	}
+	query, args, err := sqlx.In("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN (?)", now.Add(webhookDeliveryLease).Unix(), ids)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if err := deliverWebhook(ctx, job); err != nil {
+			log.Printf("failed to record webhook delivery %d: %+v", job.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// deliverWebhook は1件送信し、結果を記録する
+func deliverWebhook(ctx context.Context, job *webhookDeliveryJob) error {
+	responseStatus, sendErr := sendWebhook(ctx, job)
+
+	now := time.Now()
+	attempts := job.Attempts + 1
+	status := webhookDeliveryStatusSucceeded
+	nextAttemptAt := job.NextAttemptAt
+	var lastError sql.NullString
+	var deliveredAt sql.NullInt64
+	if sendErr == nil {
+		deliveredAt = sql.NullInt64{Int64: now.Unix(), Valid: true}
+	} else {
+		message := sendErr.Error()
+		if len(message) > webhookMaxErrorLength {
+			// マルチバイト文字の途中で切らない
+			cut := webhookMaxErrorLength
+			for cut > 0 && !utf8.RuneStart(message[cut]) {
+				cut--
+			}
+			message = message[:cut]
+		}
+		lastError = sql.NullString{String: message, Valid: true}
+		if attempts >= webhookMaxAttempts {
+			status = webhookDeliveryStatusFailed
+		} else {
+			status = webhookDeliveryStatusPending
+			nextAttemptAt = now.Add(webhookRetryBaseInterval << (attempts - 1)).Unix()
+		}
+	}
+
+	_, err := dbConn.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, response_status = ?, last_error = ?, delivered_at = ? WHERE id = ?",
+		status, attempts, nextAttemptAt, responseStatus, lastError, deliveredAt, job.ID)
+	return err
+}
+
+func sendWebhook(ctx context.Context, job *webhookDeliveryJob) (sql.NullInt64, error) {
+	body := []byte(job.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.Url, bytes.NewReader(body))
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, job.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(job.ID, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(job.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	responseStatus := sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseStatus, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return responseStatus, nil
+}
+
+// signWebhookPayload はリクエストボディのHMAC-SHA256を16進数で返す
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func fillWebhookResponse(webhookModel WebhookModel) Webhook {
+	return Webhook{
+		ID:        webhookModel.ID,
+		Url:       webhookModel.Url,
+		Events:    strings.Split(webhookModel.Events, ","),
+		CreatedAt: webhookModel.CreatedAt,
+	}
+}
+
+func fillWebhookDeliveryResponse(deliveryModel WebhookDeliveryModel) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID:             deliveryModel.ID,
+		Event:          deliveryModel.Event,
+		Status:         deliveryModel.Status,
+		Attempts:       deliveryModel.Attempts,
+		ResponseStatus: nullInt64Pointer(deliveryModel.ResponseStatus),
+		LastError:      deliveryModel.LastError.String,
+		CreatedAt:      deliveryModel.CreatedAt,
+		DeliveredAt:    nullInt64Pointer(deliveryModel.DeliveredAt),
+	}
+	if deliveryModel.Status == webhookDeliveryStatusPending {
+		nextAttemptAt := deliveryModel.NextAttemptAt
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+	return delivery
+}
@@ -0,0 +1,15 @@
+-- 配信者のフォロー
+CREATE TABLE IF NOT EXISTS `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follower_id_followee_id` (`follower_id`, `followee_id`),
+  INDEX `idx_followee_id` (`followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+ALTER TABLE users
+	ADD `followers_count` BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE users
+	ADD `following_count` BIGINT NOT NULL DEFAULT 0;
@@ -1,25 +1,45 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_waitlist;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
+TRUNCATE TABLE tag_aliases;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
+TRUNCATE TABLE livestream_series;
 TRUNCATE TABLE users;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE webhooks;
+TRUNCATE TABLE webhook_deliveries;
+TRUNCATE TABLE watch_sessions;
+TRUNCATE TABLE livestream_stats;
+TRUNCATE TABLE user_stats;
+TRUNCATE TABLE livecomment_moderation_logs;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
+ALTER TABLE `tag_aliases` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `webhooks` auto_increment = 1;
+ALTER TABLE `webhook_deliveries` auto_increment = 1;
+ALTER TABLE `watch_sessions` auto_increment = 1;
+ALTER TABLE `livecomment_moderation_logs` auto_increment = 1;
\ No newline at end of file
@@ -0,0 +1,22 @@
+-- モデレーションで非表示にしたライブコメント
+-- 削除せずに残し、配信者は確認・復元できる
+ALTER TABLE livecomments
+	ADD `hidden_at` BIGINT NULL DEFAULT NULL,
+	ADD `hidden_by` BIGINT NULL DEFAULT NULL,
+	ADD `hidden_reason` VARCHAR(255) NOT NULL DEFAULT '',
+	ADD INDEX `idx_livestream_id_hidden_at` (`livestream_id`, `hidden_at`);
+
+-- ライブコメントの非表示・復元の履歴
+CREATE TABLE IF NOT EXISTS `livecomment_moderation_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livecomment_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  -- 操作した配信者
+  `user_id` BIGINT NOT NULL,
+  -- hide, restore
+  `action` VARCHAR(16) NOT NULL,
+  `reason` VARCHAR(255) NOT NULL,
+  `ng_word_id` BIGINT NULL DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id` (`livestream_id`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
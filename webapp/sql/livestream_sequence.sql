@@ -0,0 +1,3 @@
+-- 配信内容や状態を変更するたびに増える版番号 (iCalendarのSEQUENCE)
+ALTER TABLE livestreams
+	ADD `sequence` BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+-- 繰り返し予約
+CREATE TABLE IF NOT EXISTS `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `frequency` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+ALTER TABLE livestreams
+	ADD `series_id` BIGINT NULL DEFAULT NULL;
+
+ALTER TABLE livestreams
+	ADD INDEX idx_series_id (series_id, start_at);
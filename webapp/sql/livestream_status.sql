@@ -0,0 +1,4 @@
+-- 配信の状態 (scheduled, live, ended, cancelled)
+-- 配信者が状態を遷移させるまではscheduledのままで、現在の状態は予約時間から決める
+ALTER TABLE livestreams
+	ADD `status` VARCHAR(16) NOT NULL DEFAULT 'scheduled';
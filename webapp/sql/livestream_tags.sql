@@ -0,0 +1,3 @@
+-- 既存の不正な行は `./isupipe repair-livestream-tags` で事前に削除しておくこと
+ALTER TABLE livestream_tags
+	ADD UNIQUE uniq_livestream_id_tag_id (livestream_id, tag_id);
@@ -0,0 +1,14 @@
+-- アプリ内通知
+CREATE TABLE IF NOT EXISTS `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- livestream_reserved, livestream_started, tip_received, livecomment_reported, waitlist_booked
+  `type` VARCHAR(32) NOT NULL,
+  `actor_id` BIGINT NULL DEFAULT NULL,
+  `livestream_id` BIGINT NULL DEFAULT NULL,
+  `livecomment_id` BIGINT NULL DEFAULT NULL,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `read_at` BIGINT NULL DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id_read_at` (`user_id`, `read_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,19 @@
+-- 予約枠のキャンセル待ち
+CREATE TABLE IF NOT EXISTS `reservation_waitlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  -- 付与するタグIDのJSON配列
+  `tags` TEXT NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  -- waiting, booked, withdrawn
+  `status` VARCHAR(16) NOT NULL,
+  `livestream_id` BIGINT NULL DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_status_start_at` (`status`, `start_at`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
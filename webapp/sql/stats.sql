@@ -0,0 +1,22 @@
+-- 配信ごと・配信者ごとの統計の集計値
+-- 書き込み時に更新し、reconcile-statsコマンドで元のテーブルから作り直せる
+CREATE TABLE IF NOT EXISTS `livestream_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `livecomments` BIGINT NOT NULL DEFAULT 0,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `max_tip` BIGINT NOT NULL DEFAULT 0,
+  `reactions` BIGINT NOT NULL DEFAULT 0,
+  `reports` BIGINT NOT NULL DEFAULT 0,
+  `viewers` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者の全配信の合計。max_tipは全配信での最大
+CREATE TABLE IF NOT EXISTS `user_stats` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `livecomments` BIGINT NOT NULL DEFAULT 0,
+  `tip` BIGINT NOT NULL DEFAULT 0,
+  `max_tip` BIGINT NOT NULL DEFAULT 0,
+  `reactions` BIGINT NOT NULL DEFAULT 0,
+  `reports` BIGINT NOT NULL DEFAULT 0,
+  `viewers` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,18 @@
+-- タグの階層 (親カテゴリ) と廃止日時
+ALTER TABLE tags
+	ADD `parent_id` BIGINT NULL DEFAULT NULL;
+
+ALTER TABLE tags
+	ADD `retired_at` BIGINT NULL DEFAULT NULL;
+
+ALTER TABLE tags
+	ADD INDEX idx_parent_id (parent_id);
+
+-- タグの別名 (検索用)
+CREATE TABLE IF NOT EXISTS `tag_aliases` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `tag_id` BIGINT NOT NULL,
+  `alias` VARCHAR(255) NOT NULL,
+  UNIQUE `uniq_tag_alias` (`alias`),
+  INDEX `idx_tag_id` (`tag_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,12 @@
+ALTER TABLE themes
+	ADD `accent_color` VARCHAR(7) NOT NULL DEFAULT '';
+
+ALTER TABLE themes
+	ADD `background_image_url` VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE themes
+	ADD `font_family` VARCHAR(64) NOT NULL DEFAULT '';
+
+-- CSSカスタムプロパティ (JSONオブジェクト)
+ALTER TABLE themes
+	ADD `css_variables` TEXT NOT NULL DEFAULT ('{}');
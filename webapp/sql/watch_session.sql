@@ -0,0 +1,15 @@
+-- ハートビートによる視聴セッション
+-- 退出後も履歴として残す
+CREATE TABLE IF NOT EXISTS `watch_sessions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `started_at` BIGINT NOT NULL,
+  `last_heartbeat_at` BIGINT NOT NULL,
+  `ended_at` BIGINT NULL DEFAULT NULL,
+  INDEX `idx_livestream_id_ended_at` (`livestream_id`, `ended_at`),
+  INDEX `idx_user_id_livestream_id` (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+ALTER TABLE livestreams
+	ADD `peak_viewers` BIGINT NOT NULL DEFAULT 0;
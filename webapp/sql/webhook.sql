@@ -0,0 +1,29 @@
+-- 配信者のWebhook
+CREATE TABLE IF NOT EXISTS `webhooks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(64) NOT NULL,
+  -- 購読するイベント (livecomment, tip, reaction, report) のカンマ区切り
+  `events` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Webhookの配送キューと配送ログ
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `webhook_id` BIGINT NOT NULL,
+  `event` VARCHAR(32) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  -- pending, succeeded, failed
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` BIGINT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `response_status` BIGINT NULL DEFAULT NULL,
+  `last_error` VARCHAR(255) NULL DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  `delivered_at` BIGINT NULL DEFAULT NULL,
+  INDEX `idx_status_next_attempt_at` (`status`, `next_attempt_at`),
+  INDEX `idx_webhook_id` (`webhook_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;